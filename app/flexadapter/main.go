@@ -20,6 +20,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -31,6 +35,13 @@ var (
 	driverName string
 	driverPath string
 	nodeID     string
+	// stateDir holds the volumes attached and the devices staged by the adapter.
+	stateDir string
+	// callTimeout limits the calls of the FlexVolume driver without a
+	// timeout of their own in commandTimeouts.
+	callTimeout time.Duration
+	// commandTimeouts overrides the timeouts of individual commands.
+	commandTimeouts string
 )
 
 func init() {
@@ -63,6 +74,12 @@ func main() {
 	cmd.PersistentFlags().StringVar(&driverName, "drivername", "", "name of the driver")
 	cmd.MarkPersistentFlagRequired("drivername")
 
+	cmd.PersistentFlags().StringVar(&stateDir, "statedir", "/var/lib/csi-flexadapter", "directory for the volumes attached and the devices staged by the adapter, below a subdirectory named after the driver. It must survive restarts of the adapter")
+
+	cmd.PersistentFlags().DurationVar(&callTimeout, "driver-call-timeout", 2*time.Minute, "timeout of the calls of the flexvolume driver without a timeout of their own, 0 disables the timeout")
+
+	cmd.PersistentFlags().StringVar(&commandTimeouts, "driver-command-timeouts", "", "comma separated command=duration timeouts of individual flexvolume driver commands, 0 disables the timeout. Defaults to "+formatTimeouts(flexadapter.DefaultCommandTimeouts()))
+
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err.Error())
 		os.Exit(1)
@@ -72,6 +89,24 @@ func main() {
 }
 
 func handle() {
+	timeouts := flexadapter.CallTimeouts{
+		Default:  callTimeout,
+		Commands: flexadapter.DefaultCommandTimeouts(),
+	}
+	if err := flexadapter.ParseCommandTimeouts(commandTimeouts, timeouts.Commands); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --driver-command-timeouts: %v\n", err)
+		os.Exit(1)
+	}
 	adapter := flexadapter.New()
-	adapter.Run(driverName, driverPath, nodeID, endpoint)
+	adapter.Run(driverName, driverPath, nodeID, endpoint, filepath.Join(stateDir, driverName), timeouts)
+}
+
+// formatTimeouts returns timeouts in the format of --driver-command-timeouts.
+func formatTimeouts(timeouts map[string]time.Duration) string {
+	var pairs []string
+	for command, timeout := range timeouts {
+		pairs = append(pairs, command+"="+timeout.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
@@ -28,9 +28,12 @@ func init() {
 }
 
 var (
-	endpoint   = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName = flag.String("drivername", "csi-hostpath", "name of the driver")
-	nodeID     = flag.String("nodeid", "", "node id")
+	endpoint    = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	driverName  = flag.String("drivername", "csi-hostpath", "name of the driver")
+	nodeID      = flag.String("nodeid", "", "node id")
+	dataDir     = flag.String("datadir", "/tmp/", "directory in which volumes are created")
+	snapshotDir = flag.String("snapshotdir", "/tmp/", "directory in which snapshots are stored")
+	stateDir    = flag.String("statedir", "/var/lib/csi-hostpath", "directory in which volume and snapshot metadata is persisted")
 )
 
 func main() {
@@ -42,5 +45,5 @@ func main() {
 
 func handle() {
 	driver := hostpath.GetHostPathDriver()
-	driver.Run(*driverName, *nodeID, *endpoint)
+	driver.Run(*driverName, *nodeID, *endpoint, *dataDir, *snapshotDir, *stateDir)
 }
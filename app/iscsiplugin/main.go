@@ -29,6 +29,9 @@ import (
 var (
 	endpoint string
 	nodeID   string
+	stateDir string
+
+	legacySecrets bool
 )
 
 func init() {
@@ -55,6 +58,10 @@ func main() {
 	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
 	cmd.MarkPersistentFlagRequired("endpoint")
 
+	cmd.PersistentFlags().BoolVar(&legacySecrets, "legacy-volume-context-secrets", false, "accept CHAP credentials in the \"secret\" volume attribute. The credentials are stored in the PersistentVolume in plain text. Use node stage secrets instead")
+
+	cmd.PersistentFlags().StringVar(&stateDir, "statedir", "/var/lib/csi-iscsi", "directory for the attach state of staged volumes")
+
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err.Error())
 		os.Exit(1)
@@ -64,6 +71,6 @@ func main() {
 }
 
 func handle() {
-	d := iscsi.NewDriver(nodeID, endpoint)
+	d := iscsi.NewDriver(nodeID, endpoint, stateDir, legacySecrets)
 	d.Run()
 }
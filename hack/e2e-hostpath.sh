@@ -12,7 +12,7 @@ CSI_ENDPOINT="unix://${UDS}"
 CSI_MOUNTPOINT="/mnt"
 APP=hostpathplugin
 
-SKIP="WithCapacity"
+SKIP=""
 if [ x${TRAVIS} = x"true" ] ; then
 	SKIP="ValidateVolumeCapabilities"
 fi
@@ -30,9 +30,8 @@ rm -f $UDS
 sudo _output/$APP --endpoint=$CSI_ENDPOINT --nodeid=1 &
 pid=$!
 
-# Need to skip Capacity testing since hostpath does not support it
 sudo $GOPATH/bin/csi-sanity $@ \
-    --ginkgo.skip=${SKIP} \
+    ${SKIP:+--ginkgo.skip=${SKIP}} \
     --csi.mountdir=$CSI_MOUNTPOINT \
     --csi.endpoint=$CSI_ENDPOINT ; ret=$?
 sudo kill -9 $pid
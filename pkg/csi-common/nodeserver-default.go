@@ -44,9 +44,17 @@ func (ns *DefaultNodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetIn
 	}, nil
 }
 
+// NodeGetCapabilities returns the node service capabilities added to the
+// driver, or RPC_UNKNOWN if there are none.
 func (ns *DefaultNodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	glog.V(5).Infof("Using default NodeGetCapabilities")
 
+	if len(ns.Driver.nscap) > 0 {
+		return &csi.NodeGetCapabilitiesResponse{
+			Capabilities: ns.Driver.nscap,
+		}, nil
+	}
+
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
 			{
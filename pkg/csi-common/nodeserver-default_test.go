@@ -47,6 +47,13 @@ func TestNodeGetCapabilities(t *testing.T) {
 	req := csi.NodeGetCapabilitiesRequest{}
 	_, err := ns.NodeGetCapabilities(context.Background(), &req)
 	assert.NoError(t, err)
+
+	// Test driver with node service capabilities
+	d.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_GET_VOLUME_STATS})
+	resp, err := ns.NodeGetCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(resp.GetCapabilities()))
+	assert.Equal(t, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS, resp.GetCapabilities()[0].GetRpc().GetType())
 }
 
 func TestNodePublishVolume(t *testing.T) {
@@ -22,6 +22,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -69,6 +70,16 @@ func NewControllerServiceCapability(cap csi.ControllerServiceCapability_RPC_Type
 	}
 }
 
+func NewNodeServiceCapability(cap csi.NodeServiceCapability_RPC_Type) *csi.NodeServiceCapability {
+	return &csi.NodeServiceCapability{
+		Type: &csi.NodeServiceCapability_Rpc{
+			Rpc: &csi.NodeServiceCapability_RPC{
+				Type: cap,
+			},
+		},
+	}
+}
+
 func RunNodePublishServer(endpoint string, d *CSIDriver, ns csi.NodeServer) {
 	ids := NewDefaultIdentityServer(d)
 
@@ -95,7 +106,7 @@ func RunControllerandNodePublishServer(endpoint string, d *CSIDriver, cs csi.Con
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
-	glog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	glog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(stripVolumeContextSecrets(req)))
 	resp, err := handler(ctx, req)
 	if err != nil {
 		glog.Errorf("GRPC error: %v", err)
@@ -104,3 +115,51 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+// volumeContextSecrets lists the volume context keys whose values are not
+// logged. Drivers used to receive credentials in the "secret" attribute
+// before CSI had secrets fields, and some still accept them there.
+var volumeContextSecrets = map[string]bool{
+	"secret": true,
+}
+
+// stripVolumeContextSecrets returns a copy of req with the values of the
+// volumeContextSecrets keys in its volume context replaced. protosanitizer
+// only strips fields which the CSI spec marks as secrets.
+func stripVolumeContextSecrets(req interface{}) interface{} {
+	r, ok := req.(interface {
+		GetVolumeContext() map[string]string
+	})
+	if !ok {
+		return req
+	}
+	stripped := false
+	volumeContext := map[string]string{}
+	for k, v := range r.GetVolumeContext() {
+		if volumeContextSecrets[k] {
+			v = "***stripped***"
+			stripped = true
+		}
+		volumeContext[k] = v
+	}
+	if !stripped {
+		return req
+	}
+
+	switch m := proto.Clone(req.(proto.Message)).(type) {
+	case *csi.ControllerPublishVolumeRequest:
+		m.VolumeContext = volumeContext
+		return m
+	case *csi.ValidateVolumeCapabilitiesRequest:
+		m.VolumeContext = volumeContext
+		return m
+	case *csi.NodeStageVolumeRequest:
+		m.VolumeContext = volumeContext
+		return m
+	case *csi.NodePublishVolumeRequest:
+		m.VolumeContext = volumeContext
+		return m
+	}
+	// Better log nothing than a secret
+	return fmt.Sprintf("%T with secrets in the volume context", req)
+}
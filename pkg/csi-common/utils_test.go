@@ -17,8 +17,11 @@ limitations under the License.
 package csicommon
 
 import (
+	"fmt"
 	"testing"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -74,3 +77,24 @@ func TestParseEndpoint(t *testing.T) {
 	_, _, err = ParseEndpoint("")
 	assert.NotNil(t, err)
 }
+
+func TestStripVolumeContextSecrets(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "vol",
+		VolumeContext: map[string]string{
+			"targetPortal": "10.0.0.1:3260",
+			"secret":       `{"node.session.auth.password": "chap"}`,
+		},
+		Secrets: map[string]string{"node.session.auth.password": "chap"},
+	}
+
+	logged := fmt.Sprintf("%s", protosanitizer.StripSecrets(stripVolumeContextSecrets(req)))
+	assert.NotContains(t, logged, "chap")
+	assert.Contains(t, logged, "10.0.0.1:3260")
+	// The request itself is left alone
+	assert.Equal(t, `{"node.session.auth.password": "chap"}`, req.VolumeContext["secret"])
+
+	// Requests without secrets in the volume context are not copied
+	plain := &csi.NodePublishVolumeRequest{VolumeContext: map[string]string{"server": "a.b.c.d"}}
+	assert.True(t, stripVolumeContextSecrets(plain) == interface{}(plain))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"io"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// GetVolumeStats reports the usage of the volume published at volumePath.
+// Filesystem volumes report bytes and inodes of the mounted filesystem, block
+// volumes report the size of the device. Paths which do not exist or are not
+// mounted result in NotFound.
+func GetVolumeStats(volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	return getVolumeStats(mount.New(""), volumePath)
+}
+
+func getVolumeStats(mounter mount.Interface, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	fi, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path %s does not exist", volumePath)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := mount.IsNotMountPoint(mounter, volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		return nil, status.Errorf(codes.NotFound, "Volume path %s is not mounted", volumePath)
+	}
+
+	if fi.Mode()&os.ModeDevice != 0 {
+		size, err := getDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:  csi.VolumeUsage_BYTES,
+					Total: size,
+				},
+			},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	bsize := int64(statfs.Bsize)
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * bsize,
+				Available: int64(statfs.Bavail) * bsize,
+				Used:      int64(statfs.Blocks-statfs.Bfree) * bsize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(statfs.Files),
+				Available: int64(statfs.Ffree),
+				Used:      int64(statfs.Files - statfs.Ffree),
+			},
+		},
+	}, nil
+}
+
+// getDeviceSize returns the size of a block device in bytes.
+func getDeviceSize(devicePath string) (int64, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func TestGetVolumeStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume-stats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mounter := &mount.FakeMounter{}
+
+	// Test missing path
+	_, err = getVolumeStats(mounter, "")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Test path which does not exist
+	_, err = getVolumeStats(mounter, filepath.Join(dir, "missing"))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Test path which is not mounted
+	_, err = getVolumeStats(mounter, dir)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// Test mounted path
+	mounter.MountPoints = []mount.MountPoint{{Path: dir}}
+	resp, err := getVolumeStats(mounter, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(resp.GetUsage()))
+	bytes := resp.GetUsage()[0]
+	assert.Equal(t, csi.VolumeUsage_BYTES, bytes.GetUnit())
+	assert.True(t, bytes.GetTotal() > 0)
+	assert.True(t, bytes.GetAvailable() <= bytes.GetTotal())
+	inodes := resp.GetUsage()[1]
+	assert.Equal(t, csi.VolumeUsage_INODES, inodes.GetUnit())
+}
@@ -17,7 +17,11 @@ limitations under the License.
 package flexadapter
 
 import (
+	"fmt"
+	"strconv"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -32,33 +36,72 @@ const (
 type controllerServer struct {
 	flexDriver *flexVolumeDriver
 	*csicommon.DefaultControllerServer
+	published *publishedVolumes
 }
 
+// ControllerPublishVolume attaches the volume to the node. Volumes this
+// adapter attached before are only attached again if isattached reports
+// that they are not attached anymore.
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
 		return nil, err
 	}
 
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetNodeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+
 	cap := req.GetVolumeCapability()
 	fsType := "ext4"
 	if cap != nil {
 		mount := req.GetVolumeCapability().GetMount()
-		fsType = mount.FsType
+		fsType = mount.GetFsType()
+	}
+
+	vol := publishedVolume{
+		fsType:        fsType,
+		readOnly:      req.GetReadonly(),
+		volumeContext: req.GetVolumeContext(),
+		secrets:       req.GetSecrets(),
+	}
+	volumeName, err := cs.getVolumeName(ctx, req.GetVolumeId(), vol)
+	if err != nil {
+		return nil, err
+	}
+	vol.volumeName = volumeName
+
+	if prev, ok := cs.published.get(req.GetVolumeId()); ok {
+		if devicePath, ok := prev.devicePaths[req.GetNodeId()]; ok {
+			attached, err := cs.isAttached(ctx, req.GetVolumeId(), req.GetNodeId(), vol)
+			if err != nil {
+				return nil, err
+			}
+			if attached {
+				glog.V(4).Infof("volume %s is already attached to node %s", req.GetVolumeId(), req.GetNodeId())
+				return &csi.ControllerPublishVolumeResponse{
+					PublishContext: map[string]string{deviceID: devicePath},
+				}, nil
+			}
+		}
 	}
 
 	call := cs.flexDriver.NewDriverCall(attachCmd)
-	call.AppendSpec(req.GetVolumeId(), fsType, req.GetReadonly(), req.GetVolumeContext())
+	call.AppendSpec(req.GetVolumeId(), fsType, req.GetReadonly(), "", req.GetVolumeContext(), req.GetSecrets())
 	call.Append(req.GetNodeId())
 
-	callStatus, err := call.Run()
-	if isCmdNotSupportedErr(err) {
-		return nil, status.Error(codes.Unimplemented, "")
-	} else if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	callStatus, err := call.Run(ctx)
+	if err != nil {
+		return nil, driverCallError(err)
+	}
+	if err := cs.published.publish(req.GetVolumeId(), req.GetNodeId(), callStatus.DevicePath, vol); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record volume %s as attached: %v", req.GetVolumeId(), err)
 	}
 
 	publishContext := map[string]string{}
-
 	publishContext[deviceID] = callStatus.DevicePath
 
 	return &csi.ControllerPublishVolumeResponse{
@@ -66,20 +109,49 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	}, nil
 }
 
+// ControllerUnpublishVolume detaches the volume from the node, naming it as
+// getvolumename did when it was attached. Volumes isattached reports as not
+// attached are not detached again.
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
 		return nil, err
 	}
 
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	// Unpublish requests carry no volume context, so the volume name is
+	// only known for volumes the adapter attached itself.
+	volumeName := req.GetVolumeId()
+	if vol, ok := cs.published.get(req.GetVolumeId()); ok {
+		volumeName = vol.volumeName
+		if _, ok := vol.devicePaths[req.GetNodeId()]; ok {
+			attached, err := cs.isAttached(ctx, req.GetVolumeId(), req.GetNodeId(), vol)
+			if err != nil {
+				return nil, err
+			}
+			if !attached {
+				glog.V(4).Infof("volume %s is not attached to node %s anymore", req.GetVolumeId(), req.GetNodeId())
+				if err := cs.published.unpublish(req.GetVolumeId(), req.GetNodeId()); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to record volume %s as detached: %v", req.GetVolumeId(), err)
+				}
+				return &csi.ControllerUnpublishVolumeResponse{}, nil
+			}
+		}
+	}
+
 	call := cs.flexDriver.NewDriverCall(detachCmd)
-	call.Append(req.GetVolumeId())
+	call.Append(volumeName)
 	call.Append(req.GetNodeId())
 
-	_, err := call.Run()
-	if isCmdNotSupportedErr(err) {
-		return nil, status.Error(codes.Unimplemented, "")
-	} else if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	_, err := call.Run(ctx)
+	if err != nil {
+		return nil, driverCallError(err)
+	}
+	if err := cs.published.unpublish(req.GetVolumeId(), req.GetNodeId()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record volume %s as detached: %v", req.GetVolumeId(), err)
 	}
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
@@ -88,3 +160,116 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	return cs.DefaultControllerServer.ValidateVolumeCapabilities(ctx, req)
 }
+
+// ListVolumes lists the volumes attached by this adapter as recorded. The
+// records are reconciled with isattached when the adapter starts and when a
+// volume is published or unpublished, not here. The CSI version implemented
+// has no field to return the published nodes in, they are logged instead.
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return nil, err
+	}
+
+	var volumes []*csi.Volume
+	for _, id := range cs.published.list() {
+		vol, ok := cs.published.get(id)
+		if !ok {
+			continue
+		}
+		glog.V(4).Infof("volume %s is published to nodes %v", id, vol.nodes())
+		volumes = append(volumes, &csi.Volume{
+			VolumeId:      id,
+			VolumeContext: vol.volumeContext,
+		})
+	}
+
+	var startingToken int
+	if v := req.GetStartingToken(); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 || i > len(volumes) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", v)
+		}
+		startingToken = i
+	}
+	end := len(volumes)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && startingToken+maxEntries < end {
+		end = startingToken + maxEntries
+	}
+
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, vol := range volumes[startingToken:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{Volume: vol})
+	}
+	var nextToken string
+	if end < len(volumes) {
+		nextToken = fmt.Sprintf("%d", end)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// reconcile drops the nodes isattached reports the published volumes as
+// detached from, so that volumes detached behind the back of the adapter
+// while it was not running are forgotten. Records which cannot be checked
+// are kept.
+func (cs *controllerServer) reconcile(ctx context.Context) {
+	for _, id := range cs.published.list() {
+		vol, ok := cs.published.get(id)
+		if !ok {
+			continue
+		}
+		for _, node := range vol.nodes() {
+			attached, err := cs.isAttached(ctx, id, node, vol)
+			if err != nil {
+				glog.Warningf("cannot tell if volume %s is attached to node %s, keeping it: %v", id, node, err)
+				continue
+			}
+			if attached {
+				continue
+			}
+			glog.V(4).Infof("volume %s is not attached to node %s anymore", id, node)
+			if err := cs.published.unpublish(id, node); err != nil {
+				glog.Warningf("failed to record volume %s as detached from node %s: %v", id, node, err)
+			}
+		}
+	}
+}
+
+// getVolumeName returns the name getvolumename reports for the volume, or
+// the volume ID if the driver does not support it.
+func (cs *controllerServer) getVolumeName(ctx context.Context, volumeID string, vol publishedVolume) (string, error) {
+	call := cs.flexDriver.NewDriverCall(getVolumeNameCmd)
+	call.AppendSpec(volumeID, vol.fsType, vol.readOnly, "", vol.volumeContext, vol.secrets)
+
+	callStatus, err := call.Run(ctx)
+	if isCmdNotSupportedErr(err) {
+		return volumeID, nil
+	}
+	if err != nil {
+		return "", driverCallError(err)
+	}
+	if len(callStatus.VolumeName) == 0 {
+		return volumeID, nil
+	}
+	return callStatus.VolumeName, nil
+}
+
+// isAttached returns whether isattached reports the volume as attached to
+// nodeID. Drivers not supporting it are trusted to be attached.
+func (cs *controllerServer) isAttached(ctx context.Context, volumeID, nodeID string, vol publishedVolume) (bool, error) {
+	call := cs.flexDriver.NewDriverCall(isAttached)
+	call.AppendSpec(volumeID, vol.fsType, vol.readOnly, "", vol.volumeContext, vol.secrets)
+	call.Append(nodeID)
+
+	callStatus, err := call.Run(ctx)
+	if isCmdNotSupportedErr(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, driverCallError(err)
+	}
+	return callStatus.Attached, nil
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexadapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeControllerDriverScript attaches volumes by creating a file named after
+// the node in $STATEDIR and logs the calls it receives, without their JSON
+// options, to $CALLLOG. isattached is not supported if $NO_ISATTACHED is set.
+const fakeControllerDriverScript = `#!/bin/sh
+case "$1" in
+init)
+	echo '{"status": "Success", "capabilities": {"attach": true}}'
+	;;
+getvolumename)
+	echo '{"status": "Success", "volumeName": "flex-vol"}'
+	;;
+attach)
+	echo "$1 $3" >> "$CALLLOG"
+	touch "$STATEDIR/$3"
+	echo '{"status": "Success", "device": "/dev/fake0"}'
+	;;
+detach)
+	echo "$1 $2 $3" >> "$CALLLOG"
+	rm -f "$STATEDIR/$3"
+	echo '{"status": "Success"}'
+	;;
+isattached)
+	if [ -n "$NO_ISATTACHED" ]; then
+		echo '{"status": "Not supported"}'
+		exit 1
+	fi
+	echo "$1 $3" >> "$CALLLOG"
+	if [ -e "$STATEDIR/$3" ]; then
+		echo '{"status": "Success", "attached": true}'
+	else
+		echo '{"status": "Success", "attached": false}'
+	fi
+	;;
+*)
+	echo '{"status": "Not supported"}'
+	exit 1
+	;;
+esac
+`
+
+func newFakeControllerServer(t *testing.T) (*controllerServer, string, func()) {
+	dir, err := ioutil.TempDir("", "flexadapter-controller")
+	assert.NoError(t, err)
+	driverPath := filepath.Join(dir, "driver")
+	assert.NoError(t, ioutil.WriteFile(driverPath, []byte(fakeControllerDriverScript), 0755))
+	stateDir := filepath.Join(dir, "state")
+	assert.NoError(t, os.Mkdir(stateDir, 0750))
+	os.Setenv("CALLLOG", filepath.Join(dir, "calls"))
+	os.Setenv("STATEDIR", stateDir)
+
+	f := New()
+	assert.NoError(t, f.setup("fake", driverPath, "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute}))
+	return f.cs, dir, func() {
+		os.Unsetenv("CALLLOG")
+		os.Unsetenv("STATEDIR")
+		os.Unsetenv("NO_ISATTACHED")
+		os.RemoveAll(dir)
+	}
+}
+
+func listVolumeIDs(t *testing.T, cs *controllerServer) []string {
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	var ids []string
+	for _, e := range resp.GetEntries() {
+		ids = append(ids, e.GetVolume().GetVolumeId())
+	}
+	return ids
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	cs, dir, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol",
+		NodeId:           "node1",
+		VolumeCapability: newMountCapability(),
+	}
+	resp, err := cs.ControllerPublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{deviceID: "/dev/fake0"}, resp.GetPublishContext())
+	assert.Equal(t, []string{"attach node1"}, driverCalls(t, dir))
+
+	// Publishing again does not attach again
+	resp, err = cs.ControllerPublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{deviceID: "/dev/fake0"}, resp.GetPublishContext())
+	assert.Equal(t, []string{"isattached node1"}, driverCalls(t, dir))
+
+	// A volume detached behind the back of the adapter is attached again
+	assert.NoError(t, os.Remove(filepath.Join(dir, "state", "node1")))
+	_, err = cs.ControllerPublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"isattached node1", "attach node1"}, driverCalls(t, dir))
+
+	_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{VolumeId: "vol"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestControllerUnpublishVolume(t *testing.T) {
+	cs, dir, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	// Volumes not attached by the adapter are detached by their volume ID
+	req := &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol", NodeId: "node1"}
+	_, err := cs.ControllerUnpublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"detach vol node1"}, driverCalls(t, dir))
+
+	_, err = cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol",
+		NodeId:           "node1",
+		VolumeCapability: newMountCapability(),
+	})
+	assert.NoError(t, err)
+	driverCalls(t, dir)
+
+	// Volumes attached by the adapter are detached by their volume name
+	_, err = cs.ControllerUnpublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"isattached node1", "detach flex-vol node1"}, driverCalls(t, dir))
+	assert.Empty(t, listVolumeIDs(t, cs))
+}
+
+func TestControllerServerRestart(t *testing.T) {
+	cs, dir, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	publishReq := func(node string) *csi.ControllerPublishVolumeRequest {
+		return &csi.ControllerPublishVolumeRequest{
+			VolumeId:         "vol",
+			NodeId:           node,
+			VolumeCapability: newMountCapability(),
+			VolumeContext:    map[string]string{"server": "a.b.c.d"},
+		}
+	}
+	for _, node := range []string{"node1", "node2"} {
+		_, err := cs.ControllerPublishVolume(context.Background(), publishReq(node))
+		assert.NoError(t, err)
+	}
+	driverCalls(t, dir)
+
+	// The adapter restarts
+	f := New()
+	assert.NoError(t, f.setup("fake", filepath.Join(dir, "driver"), "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute}))
+	cs = f.cs
+	assert.Equal(t, []string{"isattached node1", "isattached node2"}, driverCalls(t, dir))
+	assert.Equal(t, []string{"vol"}, listVolumeIDs(t, cs))
+
+	// Publishing again does not attach again
+	resp, err := cs.ControllerPublishVolume(context.Background(), publishReq("node1"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{deviceID: "/dev/fake0"}, resp.GetPublishContext())
+	assert.Equal(t, []string{"isattached node1"}, driverCalls(t, dir))
+
+	// Volumes are detached by their volume name
+	for _, node := range []string{"node1", "node2"} {
+		_, err = cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: "vol", NodeId: node})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"isattached node1", "detach flex-vol node1", "isattached node2", "detach flex-vol node2"}, driverCalls(t, dir))
+
+	// Nothing is left after the next restart
+	f = New()
+	assert.NoError(t, f.setup("fake", filepath.Join(dir, "driver"), "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute}))
+	assert.Empty(t, listVolumeIDs(t, f.cs))
+}
+
+func TestListVolumes(t *testing.T) {
+	cs, dir, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	for _, vol := range []string{"vol1", "vol2", "vol3"} {
+		_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         vol,
+			NodeId:           "node-" + vol,
+			VolumeCapability: newMountCapability(),
+		})
+		assert.NoError(t, err)
+	}
+	driverCalls(t, dir)
+	assert.Equal(t, []string{"vol1", "vol2", "vol3"}, listVolumeIDs(t, cs))
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetEntries(), 2)
+	assert.Equal(t, "2", resp.GetNextToken())
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: resp.GetNextToken()})
+	assert.NoError(t, err)
+	assert.Equal(t, "vol3", resp.GetEntries()[0].GetVolume().GetVolumeId())
+	assert.Empty(t, resp.GetNextToken())
+
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "4"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// Listing does not call the driver
+	assert.Empty(t, driverCalls(t, dir))
+
+	// Volumes detached behind the back of the adapter are listed until it
+	// restarts
+	assert.NoError(t, os.Remove(filepath.Join(dir, "state", "node-vol2")))
+	assert.Equal(t, []string{"vol1", "vol2", "vol3"}, listVolumeIDs(t, cs))
+	f := New()
+	assert.NoError(t, f.setup("fake", filepath.Join(dir, "driver"), "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute}))
+	cs = f.cs
+	assert.Equal(t, []string{"isattached node-vol1", "isattached node-vol2", "isattached node-vol3"}, driverCalls(t, dir))
+	assert.Equal(t, []string{"vol1", "vol3"}, listVolumeIDs(t, cs))
+
+	// Without isattached, the adapter trusts its own records
+	os.Setenv("NO_ISATTACHED", "true")
+	assert.NoError(t, os.Remove(filepath.Join(dir, "state", "node-vol3")))
+	f = New()
+	assert.NoError(t, f.setup("fake", filepath.Join(dir, "driver"), "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute}))
+	assert.Equal(t, []string{"vol1", "vol3"}, listVolumeIDs(t, f.cs))
+}
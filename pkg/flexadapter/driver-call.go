@@ -17,13 +17,21 @@ limitations under the License.
 package flexadapter
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -57,8 +65,25 @@ const (
 	optionKeyPodUID       = "kubernetes.io/pod.uid"
 
 	optionKeyServiceAccountName = "kubernetes.io/serviceAccount.name"
+
+	// Volume context keys of the pod a volume is published for, set if the
+	// CSIDriver object of the driver enables podInfoOnMount
+	podInfoPrefix                   = "csi.storage.k8s.io/"
+	volumeContextPodName            = podInfoPrefix + "pod.name"
+	volumeContextPodNamespace       = podInfoPrefix + "pod.namespace"
+	volumeContextPodUID             = podInfoPrefix + "pod.uid"
+	volumeContextServiceAccountName = podInfoPrefix + "serviceAccount.name"
 )
 
+// podInfoOptions maps the pod info volume context keys to the option keys
+// FlexVolume drivers expect them in.
+var podInfoOptions = map[string]string{
+	volumeContextPodName:            optionKeyPodName,
+	volumeContextPodNamespace:       optionKeyPodNamespace,
+	volumeContextPodUID:             optionKeyPodUID,
+	volumeContextServiceAccountName: optionKeyServiceAccountName,
+}
+
 const (
 	// StatusSuccess represents the successful completion of command.
 	StatusSuccess = "Success"
@@ -67,7 +92,10 @@ const (
 )
 
 var (
-	TimeoutError = fmt.Errorf("Timeout")
+	// TimeoutError is returned by calls which ran into their deadline.
+	TimeoutError = status.Error(codes.DeadlineExceeded, "Timeout")
+	// CanceledError is returned by calls whose context was canceled.
+	CanceledError = status.Error(codes.Canceled, "Canceled")
 )
 
 // DriverCall implements the basic contract between FlexVolume and its driver.
@@ -77,10 +105,15 @@ type DriverCall struct {
 	Command string
 	Timeout time.Duration
 	args    []string
+	// secretArgs holds the indices of args carrying secrets, which are not
+	// logged.
+	secretArgs map[int]bool
 }
 
+// NewDriverCall returns a call of command limited to the timeout of the
+// driver for command.
 func (d *flexVolumeDriver) NewDriverCall(command string) *DriverCall {
-	return d.NewDriverCallWithTimeout(command, 0)
+	return d.NewDriverCallWithTimeout(command, d.timeouts.For(command))
 }
 
 func (d *flexVolumeDriver) NewDriverCallWithTimeout(command string, timeout time.Duration) *DriverCall {
@@ -96,40 +129,64 @@ func (dc *DriverCall) Append(arg string) {
 	dc.args = append(dc.args, arg)
 }
 
-func (dc *DriverCall) AppendSpec(volumeID, fsType string, readOnly bool, volumeAttributes map[string]string) error {
-	optionsForDriver := NewOptionsForDriver(volumeID, fsType, readOnly, volumeAttributes)
+// AppendSpec appends the JSON options of the volume. mountsDir is omitted
+// from them if it is empty.
+func (dc *DriverCall) AppendSpec(volumeID, fsType string, readOnly bool, mountsDir string, volumeAttributes, secrets map[string]string) error {
+	optionsForDriver := NewOptionsForDriver(volumeID, fsType, readOnly, mountsDir, volumeAttributes, secrets)
 
 	jsonBytes, err := json.Marshal(optionsForDriver)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal spec, error: %s", err.Error())
 	}
 
+	if len(secrets) > 0 {
+		if dc.secretArgs == nil {
+			dc.secretArgs = map[int]bool{}
+		}
+		dc.secretArgs[len(dc.args)] = true
+	}
 	dc.Append(string(jsonBytes))
 	return nil
 }
 
-func (dc *DriverCall) Run() (*DriverStatus, error) {
+// loggableArgs returns the args of the call with those carrying secrets
+// masked.
+func (dc *DriverCall) loggableArgs() []string {
+	args := make([]string, len(dc.args))
+	for i, arg := range dc.args {
+		if dc.secretArgs[i] {
+			arg = "***stripped***"
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// Run runs the driver executable. If ctx is done or the timeout of the call
+// expires first, the whole process group of the executable is killed, so
+// that processes it spawned do not linger, and TimeoutError or CanceledError
+// is returned.
+func (dc *DriverCall) Run(ctx context.Context) (*DriverStatus, error) {
 	if dc.driver.isUnsupported(dc.Command) {
 		return nil, errors.New(StatusNotSupported)
 	}
 	execPath := dc.driver.getExecutable()
 
-	cmd := exec.Command(execPath, dc.args...)
-
-	timeout := false
 	if dc.Timeout > 0 {
-		timer := time.AfterFunc(dc.Timeout, func() {
-			timeout = true
-			//TODO: cmd.Stop()
-		})
-		defer timer.Stop()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dc.Timeout)
+		defer cancel()
 	}
 
-	output, execErr := cmd.CombinedOutput()
-	if execErr != nil {
-		if timeout {
+	output, execErr := dc.exec(ctx, execPath)
+	if err := ctx.Err(); err != nil && execErr != nil {
+		glog.Warningf("FlexVolume: driver call aborted: executable: %s, args: %s, error: %v", execPath, dc.loggableArgs(), err)
+		if err == context.DeadlineExceeded {
 			return nil, TimeoutError
 		}
+		return nil, CanceledError
+	}
+	if execErr != nil {
 		_, err := handleCmdResponse(dc.Command, output)
 		if err == nil {
 			glog.Errorf("FlexVolume: driver bug: %s: exec error (%s) but no error in response.", execPath, execErr)
@@ -138,7 +195,7 @@ func (dc *DriverCall) Run() (*DriverStatus, error) {
 		if isCmdNotSupportedErr(err) {
 			dc.driver.unsupported(dc.Command)
 		} else {
-			glog.Warningf("FlexVolume: driver call failed: executable: %s, args: %s, error: %s, output: %q", execPath, dc.args, execErr.Error(), output)
+			glog.Warningf("FlexVolume: driver call failed: executable: %s, args: %s, error: %s, output: %q", execPath, dc.loggableArgs(), execErr.Error(), output)
 		}
 		return nil, err
 	}
@@ -154,10 +211,71 @@ func (dc *DriverCall) Run() (*DriverStatus, error) {
 	return status, nil
 }
 
+// execWaitDelay is how long exec waits for the output of a driver to be
+// closed once the driver exited or was killed.
+const execWaitDelay = 5 * time.Second
+
+// exec runs execPath in a process group of its own and returns its combined
+// output. The process group is killed once ctx is done.
+func (dc *DriverCall) exec(ctx context.Context, execPath string) ([]byte, error) {
+	// The output is read through a pipe of our own, so that children which
+	// left the process group and keep it open cannot block Wait.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cmd := exec.Command(execPath, dc.args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, r)
+		close(copied)
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// A negative pid signals the process group
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			glog.Errorf("FlexVolume: failed to kill %s: %v", execPath, err)
+		}
+		err = <-done
+	}
+
+	// The output must not be read before it was copied completely
+	select {
+	case <-copied:
+	case <-time.After(execWaitDelay):
+		glog.Warningf("FlexVolume: %s exited but its output was kept open by its children", execPath)
+		r.Close()
+		<-copied
+	}
+	return output.Bytes(), err
+}
+
 // OptionsForDriver represents the spec given to the driver.
 type OptionsForDriver map[string]string
 
-func NewOptionsForDriver(volumeID, fsType string, readOnly bool, volumeAttributes map[string]string) OptionsForDriver {
+// NewOptionsForDriver returns the options kubelet would pass for the volume.
+// Secrets are passed base64 encoded, each under its own key below
+// kubernetes.io/secret. Pod info found in volumeAttributes is passed under
+// the keys kubelet uses for it. CSI requests carry no fsGroup, so
+// kubernetes.io/fsGroup is never set.
+func NewOptionsForDriver(volumeID, fsType string, readOnly bool, mountsDir string, volumeAttributes, secrets map[string]string) OptionsForDriver {
 	options := map[string]string{}
 
 	if readOnly {
@@ -169,8 +287,19 @@ func NewOptionsForDriver(volumeID, fsType string, readOnly bool, volumeAttribute
 	options[optionFSType] = fsType
 	options[optionPVorVolumeName] = volumeID
 
+	if len(mountsDir) > 0 {
+		options[optionMountsDir] = mountsDir
+	}
+
 	for key, value := range volumeAttributes {
 		options[key] = value
+		if option, ok := podInfoOptions[key]; ok {
+			options[option] = value
+		}
+	}
+
+	for name, secret := range secrets {
+		options[optionKeySecret+"/"+name] = base64.StdEncoding.EncodeToString([]byte(secret))
 	}
 
 	return OptionsForDriver(options)
@@ -217,6 +346,18 @@ func isCmdNotSupportedErr(err error) bool {
 	return false
 }
 
+// driverCallError converts an error of a driver call into a gRPC error.
+// Timeouts and cancellations keep their codes.
+func driverCallError(err error) error {
+	if isCmdNotSupportedErr(err) {
+		return status.Error(codes.Unimplemented, "")
+	}
+	if err == TimeoutError || err == CanceledError {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
 // handleCmdResponse processes the command output and returns the appropriate
 // error code or message.
 func handleCmdResponse(cmd string, output []byte) (*DriverStatus, error) {
@@ -231,7 +372,7 @@ func handleCmdResponse(cmd string, output []byte) (*DriverStatus, error) {
 		return nil, errors.New(status.Status)
 	} else if status.Status != StatusSuccess {
 		errMsg := fmt.Sprintf("%s command failed, status: %s, reason: %s", cmd, status.Status, status.Message)
-		glog.Errorf(errMsg)
+		glog.Error(errMsg)
 		return nil, fmt.Errorf("%s", errMsg)
 	}
 
@@ -0,0 +1,255 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexadapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeDriverScript answers init and mount, and hangs on waitforattach after
+// spawning a child which writes its pid to the file named by $PIDFILE. On
+// mountdevice, it leaves a child behind in a session of its own which keeps
+// the output open.
+const fakeDriverScript = `#!/bin/sh
+case "$1" in
+init)
+	echo '{"status": "Success", "capabilities": {"attach": false}}'
+	;;
+mount)
+	echo '{"status": "Success"}'
+	;;
+mountdevice)
+	setsid sleep 30 &
+	echo '{"status": "Success"}'
+	;;
+waitforattach)
+	sh -c 'echo $$ > "$PIDFILE"; sleep 30' &
+	sleep 30
+	;;
+*)
+	echo '{"status": "Not supported"}'
+	exit 1
+	;;
+esac
+`
+
+func newFakeFlexVolumeDriver(t *testing.T, timeout time.Duration) (*flexVolumeDriver, string, func()) {
+	dir, err := ioutil.TempDir("", "flexadapter")
+	assert.NoError(t, err)
+	driverPath := filepath.Join(dir, "driver")
+	assert.NoError(t, ioutil.WriteFile(driverPath, []byte(fakeDriverScript), 0755))
+	pidFile := filepath.Join(dir, "pid")
+	os.Setenv("PIDFILE", pidFile)
+
+	d, err := NewFlexVolumeDriver("fake", driverPath, CallTimeouts{Default: timeout})
+	assert.NoError(t, err)
+	return d, pidFile, func() {
+		os.Unsetenv("PIDFILE")
+		os.RemoveAll(dir)
+	}
+}
+
+// assertKilled checks that the process whose pid is in pidFile is gone.
+func assertKilled(t *testing.T, pidFile string) {
+	data, err := ioutil.ReadFile(pidFile)
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	assert.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("child process %d of the driver is still running", pid)
+}
+
+func TestNewFlexVolumeDriver(t *testing.T) {
+	d, _, cleanup := newFakeFlexVolumeDriver(t, time.Minute)
+	defer cleanup()
+
+	assert.False(t, d.capabilities.Attach)
+	assert.True(t, d.capabilities.SELinuxRelabel)
+}
+
+func TestDriverCallRun(t *testing.T) {
+	d, _, cleanup := newFakeFlexVolumeDriver(t, time.Minute)
+	defer cleanup()
+
+	ds, err := d.NewDriverCall(mountCmd).Run(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, ds.Status)
+
+	_, err = d.NewDriverCall(unmountCmd).Run(context.Background())
+	assert.True(t, isCmdNotSupportedErr(err))
+	assert.True(t, d.isUnsupported(unmountCmd))
+}
+
+func TestDriverCallTimeout(t *testing.T) {
+	d, pidFile, cleanup := newFakeFlexVolumeDriver(t, 500*time.Millisecond)
+	defer cleanup()
+
+	start := time.Now()
+	_, err := d.NewDriverCall(waitForAttachCmd).Run(context.Background())
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.True(t, time.Since(start) < 10*time.Second, "call was not killed in time")
+	assertKilled(t, pidFile)
+}
+
+func TestDriverCallDeadline(t *testing.T) {
+	d, pidFile, cleanup := newFakeFlexVolumeDriver(t, 0)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := d.NewDriverCall(waitForAttachCmd).Run(ctx)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assertKilled(t, pidFile)
+}
+
+func TestDriverCallCanceled(t *testing.T) {
+	d, pidFile, cleanup := newFakeFlexVolumeDriver(t, 0)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+	_, err := d.NewDriverCall(waitForAttachCmd).Run(ctx)
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assertKilled(t, pidFile)
+}
+
+func TestDriverCallEscapedChild(t *testing.T) {
+	d, _, cleanup := newFakeFlexVolumeDriver(t, time.Minute)
+	defer cleanup()
+
+	start := time.Now()
+	ds, err := d.NewDriverCall(mountDeviceCmd).Run(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, ds.Status)
+	assert.True(t, time.Since(start) < 20*time.Second, "call waited for the child of the driver")
+}
+
+func TestCallTimeouts(t *testing.T) {
+	timeouts := CallTimeouts{Default: 2 * time.Minute, Commands: DefaultCommandTimeouts()}
+	assert.Equal(t, 10*time.Minute, timeouts.For(attachCmd))
+	assert.Equal(t, 30*time.Second, timeouts.For(initCmd))
+	assert.Equal(t, 2*time.Minute, timeouts.For(mountCmd))
+
+	assert.NoError(t, ParseCommandTimeouts("attach=30m,mount=0", timeouts.Commands))
+	assert.Equal(t, 30*time.Minute, timeouts.For(attachCmd))
+	assert.Equal(t, time.Duration(0), timeouts.For(mountCmd))
+	assert.Equal(t, 30*time.Second, timeouts.For(initCmd))
+
+	for _, value := range []string{"attach", "attach=forever", "attach=-1s", "format=1m"} {
+		assert.Error(t, ParseCommandTimeouts(value, timeouts.Commands), value)
+	}
+}
+
+func TestNewOptionsForDriver(t *testing.T) {
+	testCases := []struct {
+		name             string
+		readOnly         bool
+		mountsDir        string
+		volumeAttributes map[string]string
+		secrets          map[string]string
+		expectedOptions  OptionsForDriver
+	}{
+		{
+			name: "defaults",
+			expectedOptions: OptionsForDriver{
+				optionFSType:         "ext4",
+				optionReadWrite:      "rw",
+				optionPVorVolumeName: "vol",
+			},
+		},
+		{
+			name:             "attributes",
+			readOnly:         true,
+			mountsDir:        "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/vol",
+			volumeAttributes: map[string]string{"server": "a.b.c.d"},
+			expectedOptions: OptionsForDriver{
+				optionFSType:         "ext4",
+				optionReadWrite:      "ro",
+				optionPVorVolumeName: "vol",
+				optionMountsDir:      "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/vol",
+				"server":             "a.b.c.d",
+			},
+		},
+		{
+			name: "pod info",
+			volumeAttributes: map[string]string{
+				volumeContextPodName:            "pod",
+				volumeContextPodNamespace:       "default",
+				volumeContextPodUID:             "0b3e0d8e-fa2c-11e8-8eb2-f2801f1b9fd1",
+				volumeContextServiceAccountName: "sa",
+			},
+			expectedOptions: OptionsForDriver{
+				optionFSType:                    "ext4",
+				optionReadWrite:                 "rw",
+				optionPVorVolumeName:            "vol",
+				optionKeyPodName:                "pod",
+				optionKeyPodNamespace:           "default",
+				optionKeyPodUID:                 "0b3e0d8e-fa2c-11e8-8eb2-f2801f1b9fd1",
+				optionKeyServiceAccountName:     "sa",
+				volumeContextPodName:            "pod",
+				volumeContextPodNamespace:       "default",
+				volumeContextPodUID:             "0b3e0d8e-fa2c-11e8-8eb2-f2801f1b9fd1",
+				volumeContextServiceAccountName: "sa",
+			},
+		},
+		{
+			name:    "secrets",
+			secrets: map[string]string{"username": "admin", "password": "secret"},
+			expectedOptions: OptionsForDriver{
+				optionFSType:                    "ext4",
+				optionReadWrite:                 "rw",
+				optionPVorVolumeName:            "vol",
+				"kubernetes.io/secret/username": "YWRtaW4=",
+				"kubernetes.io/secret/password": "c2VjcmV0",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := NewOptionsForDriver("vol", "ext4", tc.readOnly, tc.mountsDir, tc.volumeAttributes, tc.secrets)
+			assert.Equal(t, tc.expectedOptions, options)
+		})
+	}
+}
+
+func TestLoggableArgs(t *testing.T) {
+	dc := (&flexVolumeDriver{}).NewDriverCall(attachCmd)
+	assert.NoError(t, dc.AppendSpec("vol", "ext4", false, "", nil, map[string]string{"password": "secret"}))
+	dc.Append("node1")
+
+	args := dc.loggableArgs()
+	assert.Equal(t, []string{attachCmd, "***stripped***", "node1"}, args)
+	assert.Contains(t, dc.args[1], "c2VjcmV0")
+}
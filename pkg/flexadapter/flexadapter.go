@@ -17,10 +17,14 @@ limitations under the License.
 package flexadapter
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/util/mount"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -45,42 +49,75 @@ func New() *flexAdapter {
 	return &flexAdapter{}
 }
 
-func NewControllerServer(d *csicommon.CSIDriver, f *flexVolumeDriver) *controllerServer {
+func NewControllerServer(d *csicommon.CSIDriver, f *flexVolumeDriver, published *publishedVolumes) *controllerServer {
 	return &controllerServer{
 		flexDriver:              f,
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		published:               published,
 	}
 }
 
-func NewNodeServer(d *csicommon.CSIDriver, f *flexVolumeDriver) *nodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, f *flexVolumeDriver, staged *stagedDevices) *nodeServer {
 	return &nodeServer{
 		flexDriver:        f,
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		mounter:           mount.New(""),
+		staged:            staged,
 	}
 }
 
-func (f *flexAdapter) Run(driverName, driverPath, nodeID, endpoint string) {
-	var err error
-
+// Run serves the FlexVolume driver at driverPath on endpoint. The volumes
+// attached and the devices staged by the adapter are persisted in stateDir. Driver calls taking
+// longer than their timeout are killed.
+func (f *flexAdapter) Run(driverName, driverPath, nodeID, endpoint, stateDir string, timeouts CallTimeouts) {
 	glog.Infof("Driver: %v version: %v", driverName, version)
 
-	// Create flex volume driver
-	f.flexDriver, err = NewFlexVolumeDriver(driverName, driverPath)
-	if err != nil {
+	if err := f.setup(driverName, driverPath, nodeID, stateDir, timeouts); err != nil {
 		glog.Errorf("Failed to initialize flex volume driver, error: %v", err.Error())
 		os.Exit(1)
 	}
 
+	csicommon.RunControllerandNodePublishServer(endpoint, f.driver, f.cs, f.ns)
+}
+
+// setup runs init of the FlexVolume driver and advertises the CSI
+// capabilities matching the capabilities it reports. Only attachable
+// drivers support ControllerPublishVolume and stage their devices.
+func (f *flexAdapter) setup(driverName, driverPath, nodeID, stateDir string, timeouts CallTimeouts) error {
+	var err error
+
+	// Create flex volume driver
+	f.flexDriver, err = NewFlexVolumeDriver(driverName, driverPath, timeouts)
+	if err != nil {
+		return fmt.Errorf("%s of %s failed: %v", initCmd, driverPath, err)
+	}
+	glog.Infof("FlexVolume driver capabilities: attach: %v, selinuxRelabel: %v", f.flexDriver.capabilities.Attach, f.flexDriver.capabilities.SELinuxRelabel)
+
 	// Initialize default library driver
 	f.driver = csicommon.NewCSIDriver(driverName, version, nodeID)
 	if f.flexDriver.capabilities.Attach {
-		f.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME})
+		f.driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		})
+		f.driver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME})
 	}
 	f.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
+	published, err := loadPublishedVolumes(stateDir)
+	if err != nil {
+		return fmt.Errorf("failed to load the published volumes from %s: %v", stateDir, err)
+	}
+	staged, err := newStagedDevices(filepath.Join(stateDir, "staged"))
+	if err != nil {
+		return fmt.Errorf("failed to load the staged devices from %s: %v", stateDir, err)
+	}
+
 	// Create GRPC servers
-	f.ns = NewNodeServer(f.driver, f.flexDriver)
-	f.cs = NewControllerServer(f.driver, f.flexDriver)
+	f.ns = NewNodeServer(f.driver, f.flexDriver, staged)
+	f.cs = NewControllerServer(f.driver, f.flexDriver, published)
 
-	csicommon.RunControllerandNodePublishServer(endpoint, f.driver, f.cs, f.ns)
+	// Forget volumes which were detached while the adapter was not running
+	f.cs.reconcile(context.Background())
+	return nil
 }
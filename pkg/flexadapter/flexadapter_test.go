@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexadapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSetup(t *testing.T) {
+	attachableCaps := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	}
+
+	testCases := []struct {
+		name string
+		// initOutput is printed by the driver on init.
+		initOutput    string
+		initExitCode  int
+		expectedError bool
+		expectedCaps  []csi.ControllerServiceCapability_RPC_Type
+	}{
+		{
+			name:         "attachable",
+			initOutput:   `{"status": "Success", "capabilities": {"attach": true}}`,
+			expectedCaps: attachableCaps,
+		},
+		{
+			name:       "not attachable",
+			initOutput: `{"status": "Success", "capabilities": {"attach": false}}`,
+		},
+		{
+			name:         "default capabilities",
+			initOutput:   `{"status": "Success"}`,
+			expectedCaps: attachableCaps,
+		},
+		{
+			name:         "null capabilities",
+			initOutput:   `{"status": "Success", "capabilities": null}`,
+			expectedCaps: attachableCaps,
+		},
+		{
+			name:          "init failure",
+			initOutput:    `{"status": "Failure", "message": "broken"}`,
+			initExitCode:  1,
+			expectedError: true,
+		},
+		{
+			name:          "init not supported",
+			initOutput:    `{"status": "Not supported"}`,
+			initExitCode:  1,
+			expectedError: true,
+		},
+		{
+			name:          "invalid output",
+			initOutput:    `usage: driver <command>`,
+			initExitCode:  1,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "flexadapter")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			driverPath := filepath.Join(dir, "driver")
+			script := "#!/bin/sh\necho '" + tc.initOutput + "'\nexit " + strconv.Itoa(tc.initExitCode) + "\n"
+			assert.NoError(t, ioutil.WriteFile(driverPath, []byte(script), 0755))
+
+			f := New()
+			err = f.setup("fake", driverPath, "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute})
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			resp, err := f.cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+			assert.NoError(t, err)
+			var caps []csi.ControllerServiceCapability_RPC_Type
+			for _, c := range resp.GetCapabilities() {
+				caps = append(caps, c.GetRpc().GetType())
+			}
+			assert.Equal(t, tc.expectedCaps, caps)
+
+			// Attachable drivers stage their devices
+			nodeResp, err := f.ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+			assert.NoError(t, err)
+			expectedNodeCap := csi.NodeServiceCapability_RPC_UNKNOWN
+			if f.flexDriver.capabilities.Attach {
+				expectedNodeCap = csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME
+			}
+			assert.Equal(t, expectedNodeCap, nodeResp.GetCapabilities()[0].GetRpc().GetType())
+		})
+	}
+}
@@ -17,7 +17,12 @@ limitations under the License.
 package flexadapter
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 type flexVolumeDriver struct {
@@ -26,6 +31,77 @@ type flexVolumeDriver struct {
 	execPath            string
 	unsupportedCommands []string
 	capabilities        DriverCapabilities
+	// timeouts limit the driver calls.
+	timeouts CallTimeouts
+}
+
+// CallTimeouts limits the calls of a FlexVolume driver. A zero timeout
+// disables the limit.
+type CallTimeouts struct {
+	// Default limits the commands missing in Commands.
+	Default time.Duration
+	// Commands holds the timeouts of individual commands.
+	Commands map[string]time.Duration
+}
+
+// For returns the timeout of command.
+func (t CallTimeouts) For(command string) time.Duration {
+	if timeout, ok := t.Commands[command]; ok {
+		return timeout
+	}
+	return t.Default
+}
+
+// DefaultCommandTimeouts returns the timeouts of the commands which differ
+// from the default timeout: queries are expected to return quickly, while
+// attaching and detaching may wait for the storage backend.
+func DefaultCommandTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		initCmd:          30 * time.Second,
+		getVolumeNameCmd: 30 * time.Second,
+		isAttached:       30 * time.Second,
+		attachCmd:        10 * time.Minute,
+		waitForAttachCmd: 10 * time.Minute,
+		mountDeviceCmd:   10 * time.Minute,
+		detachCmd:        10 * time.Minute,
+		waitForDetachCmd: 10 * time.Minute,
+	}
+}
+
+// knownCommands lists the driver commands the adapter calls.
+var knownCommands = []string{
+	initCmd, getVolumeNameCmd, isAttached,
+	attachCmd, waitForAttachCmd, mountDeviceCmd,
+	detachCmd, waitForDetachCmd, unmountDeviceCmd,
+	mountCmd, unmountCmd,
+}
+
+// ParseCommandTimeouts parses a comma separated list of command=duration
+// pairs into timeouts, replacing the timeouts of the commands listed.
+func ParseCommandTimeouts(value string, timeouts map[string]time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("%q is not of the form command=duration", pair)
+		}
+		command := pair[:i]
+		known := false
+		for _, c := range knownCommands {
+			known = known || c == command
+		}
+		if !known {
+			return fmt.Errorf("unknown command %q", command)
+		}
+		timeout, err := time.ParseDuration(pair[i+1:])
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("invalid timeout of command %s: %q", command, pair[i+1:])
+		}
+		timeouts[command] = timeout
+	}
+	return nil
 }
 
 // Returns true iff the given command is known to be unsupported.
@@ -51,21 +127,26 @@ func (d *flexVolumeDriver) unsupported(commands ...string) {
 	d.unsupportedCommands = append(d.unsupportedCommands, commands...)
 }
 
-func NewFlexVolumeDriver(driverName, driverPath string) (*flexVolumeDriver, error) {
+func NewFlexVolumeDriver(driverName, driverPath string, timeouts CallTimeouts) (*flexVolumeDriver, error) {
 
 	flexDriver := &flexVolumeDriver{
 		driverName: driverName,
 		execPath:   driverPath,
+		timeouts:   timeouts,
 	}
 
 	// Initialize the plugin and probe the capabilities
 	call := flexDriver.NewDriverCall(initCmd)
-	ds, err := call.Run()
+	ds, err := call.Run(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	flexDriver.capabilities = *ds.Capabilities
+	// Drivers may reply with "capabilities": null
+	flexDriver.capabilities = *defaultCapabilities()
+	if ds.Capabilities != nil {
+		flexDriver.capabilities = *ds.Capabilities
+	}
 
 	return flexDriver, nil
 }
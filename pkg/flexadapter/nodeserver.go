@@ -18,8 +18,10 @@ package flexadapter
 
 import (
 	"os"
+	"path/filepath"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -32,9 +34,11 @@ import (
 type nodeServer struct {
 	flexDriver *flexVolumeDriver
 	*csicommon.DefaultNodeServer
+	mounter mount.Interface
+	staged  *stagedDevices
 }
 
-func mountDevice(devicePath, targetPath, fsType string, readOnly bool, mountOptions []string) error {
+func mountDevice(mounter mount.Interface, devicePath, targetPath, fsType string, readOnly bool, mountOptions []string) error {
 	var options []string
 
 	if readOnly {
@@ -44,12 +48,14 @@ func mountDevice(devicePath, targetPath, fsType string, readOnly bool, mountOpti
 	}
 	options = append(options, mountOptions...)
 
-	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()}
+	diskMounter := &mount.SafeFormatAndMount{Interface: mounter, Exec: mount.NewOsExec()}
 
 	return diskMounter.FormatAndMount(devicePath, targetPath, fsType, options)
 }
 
-func (ns *nodeServer) waitForAttach(req *csi.NodePublishVolumeRequest, fsType string) error {
+// waitForAttach returns the device the attach of the volume reported in the
+// publish context, as found on this node by waitforattach.
+func (ns *nodeServer) waitForAttach(ctx context.Context, req *csi.NodeStageVolumeRequest, fsType string) (string, error) {
 
 	var dID string
 
@@ -57,37 +63,65 @@ func (ns *nodeServer) waitForAttach(req *csi.NodePublishVolumeRequest, fsType st
 		var ok bool
 		dID, ok = req.GetPublishContext()[deviceID]
 		if !ok {
-			return status.Error(codes.InvalidArgument, "Missing device ID")
+			return "", status.Error(codes.InvalidArgument, "Missing device ID")
 		}
 	} else {
-		return status.Error(codes.InvalidArgument, "Missing publish info and device ID")
+		return "", status.Error(codes.InvalidArgument, "Missing publish info and device ID")
 	}
 
 	call := ns.flexDriver.NewDriverCall(waitForAttachCmd)
 	call.Append(dID)
-	call.AppendSpec(req.GetVolumeId(), fsType, req.GetReadonly(), req.GetVolumeContext())
+	call.AppendSpec(req.GetVolumeId(), fsType, false, filepath.Dir(req.GetStagingTargetPath()), req.GetVolumeContext(), req.GetSecrets())
 
-	_, err := call.Run()
+	callStatus, err := call.Run(ctx)
 	if isCmdNotSupportedErr(err) {
-		return nil
+		return dID, nil
 	}
 
 	if err != nil {
-		status.Error(codes.Internal, err.Error())
+		return "", driverCallError(err)
 	}
 
-	return nil
+	if len(callStatus.DevicePath) > 0 {
+		return callStatus.DevicePath, nil
+	}
+	return dID, nil
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+// NodeStageVolume waits for the device of attachable drivers and mounts it at
+// the staging path with mountdevice, falling back to formatting and mounting
+// it here. Drivers which do not attach mount volumes on publish.
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
 
-	targetPath := req.GetTargetPath()
+	if !ns.flexDriver.capabilities.Attach {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	stagingPath := req.GetStagingTargetPath()
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	devicePath, err := ns.waitForAttach(ctx, req, fsType)
+	if err != nil {
+		return nil, err
+	}
+	if err := ns.staged.stage(req.GetVolumeId(), stagingPath, devicePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record device %s of volume %s: %v", devicePath, req.GetVolumeId(), err)
+	}
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, 0750); err != nil {
+			if err := os.MkdirAll(stagingPath, 0750); err != nil {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
 			notMnt = true
@@ -97,74 +131,207 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	call := ns.flexDriver.NewDriverCall(mountDeviceCmd)
+	call.Append(stagingPath)
+	call.Append(devicePath)
+	call.AppendSpec(req.GetVolumeId(), fsType, false, filepath.Dir(req.GetStagingTargetPath()), req.GetVolumeContext(), req.GetSecrets())
+
+	_, err = call.Run(ctx)
+	if isCmdNotSupportedErr(err) {
+		mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+		glog.V(4).Infof("mounting %s at %s", devicePath, stagingPath)
+		if err := mountDevice(ns.mounter, devicePath, stagingPath, fsType, false, mountFlags); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if err != nil {
+		return nil, driverCallError(err)
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the staging path with unmountdevice, falling
+// back to unmounting it here, and waits for the device recorded at stage time
+// to be detached with waitfordetach.
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	if !ns.flexDriver.capabilities.Attach {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	devicePath, err := ns.staged.device(stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	mounted := true
+	if _, err := os.Stat(stagingPath); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.V(4).Infof("%s does not exist, already unmounted", stagingPath)
+		mounted = false
+	}
+
+	if mounted {
+		// Volumes staged before devices were recorded are looked up in the
+		// mount table while they are still mounted
+		if len(devicePath) == 0 {
+			if devicePath, _, err = mount.GetDeviceNameFromMount(ns.mounter, stagingPath); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		call := ns.flexDriver.NewDriverCall(unmountDeviceCmd)
+		call.Append(stagingPath)
+
+		_, err = call.Run(ctx)
+		if isCmdNotSupportedErr(err) {
+			if err := util.UnmountPath(stagingPath, ns.mounter); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		} else if err != nil {
+			return nil, driverCallError(err)
+		} else if err := os.Remove(stagingPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
-	var call *DriverCall
+	// The device stays recorded until waitfordetach succeeded, so that a
+	// retry after the staging path is gone still waits for it
+	if len(devicePath) > 0 {
+		call := ns.flexDriver.NewDriverCall(waitForDetachCmd)
+		call.Append(devicePath)
+		if _, err := call.Run(ctx); err != nil && !isCmdNotSupportedErr(err) {
+			return nil, driverCallError(err)
+		}
+	}
+	if err := ns.staged.unstage(stagingPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to forget device %s of volume %s: %v", devicePath, req.GetVolumeId(), err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind-mounts the staging path to the target path for
+// attachable drivers. Other drivers mount the volume at the target path with
+// mount.
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
 
-	// Attachable driver.
+	stagingPath := req.GetStagingTargetPath()
 	if ns.flexDriver.capabilities.Attach {
-		err = ns.waitForAttach(req, fsType)
-		if err != nil {
-			return nil, err
+		if len(stagingPath) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
 		}
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err != nil || notMnt {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", req.GetVolumeId(), stagingPath)
+		}
+	}
 
-		call = ns.flexDriver.NewDriverCall(mountDeviceCmd)
-	} else {
-		call = ns.flexDriver.NewDriverCall(mountCmd)
+	targetPath := req.GetTargetPath()
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(targetPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
-	call.Append(req.GetTargetPath())
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
 
-	if req.GetPublishContext() != nil {
-		call.Append(req.GetPublishContext()[deviceID])
+	if ns.flexDriver.capabilities.Attach {
+		options := []string{"bind"}
+		if req.GetReadonly() {
+			options = append(options, "ro")
+		}
+		glog.V(4).Infof("bind mounting %s at %s", stagingPath, targetPath)
+		if err := ns.mounter.Mount(stagingPath, targetPath, "", options); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	call.AppendSpec(req.GetVolumeId(), fsType, req.GetReadonly(), req.GetVolumeContext())
-	_, err = call.Run()
+	call := ns.flexDriver.NewDriverCall(mountCmd)
+	call.Append(targetPath)
+	call.AppendSpec(req.GetVolumeId(), fsType, req.GetReadonly(), "", req.GetVolumeContext(), req.GetSecrets())
+
+	_, err = call.Run(ctx)
 	if isCmdNotSupportedErr(err) {
 		mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-		err := mountDevice(req.VolumeContext[deviceID], targetPath, fsType, req.GetReadonly(), mountFlags)
+		err := mountDevice(ns.mounter, req.GetVolumeContext()[deviceID], targetPath, fsType, req.GetReadonly(), mountFlags)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, driverCallError(err)
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func unmountDevice(path string) error {
-	return util.UnmountPath(path, mount.New(""))
-}
-
+// NodeUnpublishVolume unmounts the target path. Drivers which do not attach
+// unmount it with unmount, falling back to unmounting it here.
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
 
-	var call *DriverCall
+	targetPath := req.GetTargetPath()
 	if ns.flexDriver.capabilities.Attach {
-		call = ns.flexDriver.NewDriverCall(unmountDeviceCmd)
-	} else {
-		call = ns.flexDriver.NewDriverCall(unmountCmd)
+		if err := util.UnmountPath(targetPath, ns.mounter); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
-	call.Append(req.GetTargetPath())
 
-	_, err := call.Run()
+	call := ns.flexDriver.NewDriverCall(unmountCmd)
+	call.Append(targetPath)
+
+	_, err := call.Run(ctx)
 	if isCmdNotSupportedErr(err) {
-		err := unmountDevice(req.GetTargetPath())
-		return nil, status.Error(codes.Internal, err.Error())
+		if err := util.UnmountPath(targetPath, ns.mounter); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	} else if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, driverCallError(err)
 	}
 
-	// WaitForDetach is ignored in current K8S plugins
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
-
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return &csi.NodeUnstageVolumeResponse{}, nil
-}
-
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
-}
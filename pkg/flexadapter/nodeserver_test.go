@@ -0,0 +1,261 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexadapter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// fakeNodeDriverScript logs the calls it receives, without their JSON
+// options, to the file named by $CALLLOG. It is attachable unless $ATTACH is
+// "false". waitfordetach fails while the file named by $DETACHBUSY exists.
+const fakeNodeDriverScript = `#!/bin/sh
+case "$1" in
+init)
+	echo "{\"status\": \"Success\", \"capabilities\": {\"attach\": ${ATTACH:-true}}}"
+	;;
+waitforattach)
+	echo "$1 $2" >> "$CALLLOG"
+	echo '{"status": "Success", "device": "/dev/fake0"}'
+	;;
+mountdevice)
+	echo "$1 $2 $3" >> "$CALLLOG"
+	echo '{"status": "Success"}'
+	;;
+waitfordetach)
+	echo "$1 $2" >> "$CALLLOG"
+	if [ -n "$DETACHBUSY" ] && [ -e "$DETACHBUSY" ]; then
+		echo '{"status": "Failure", "message": "busy"}'
+		exit 1
+	fi
+	echo '{"status": "Success"}'
+	;;
+unmountdevice|mount|unmount)
+	echo "$1 $2" >> "$CALLLOG"
+	echo '{"status": "Success"}'
+	;;
+*)
+	echo '{"status": "Not supported"}'
+	exit 1
+	;;
+esac
+`
+
+func newFakeNodeServer(t *testing.T, attach bool) (*nodeServer, *mount.FakeMounter, string, func()) {
+	dir, err := ioutil.TempDir("", "flexadapter-node")
+	assert.NoError(t, err)
+	driverPath := filepath.Join(dir, "driver")
+	assert.NoError(t, ioutil.WriteFile(driverPath, []byte(fakeNodeDriverScript), 0755))
+	os.Setenv("CALLLOG", filepath.Join(dir, "calls"))
+	if !attach {
+		os.Setenv("ATTACH", "false")
+	}
+
+	f := New()
+	assert.NoError(t, f.setup("fake", driverPath, "fakeNodeID", filepath.Join(dir, "adapter"), CallTimeouts{Default: time.Minute}))
+	mounter := &mount.FakeMounter{}
+	f.ns.mounter = mounter
+	return f.ns, mounter, dir, func() {
+		os.Unsetenv("CALLLOG")
+		os.Unsetenv("ATTACH")
+		os.Unsetenv("DETACHBUSY")
+		os.RemoveAll(dir)
+	}
+}
+
+// driverCalls returns and forgets the calls logged by fakeNodeDriverScript.
+func driverCalls(t *testing.T, dir string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "calls")))
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func newMountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	ns, _, dir, cleanup := newFakeNodeServer(t, true)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  newMountCapability(),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		PublishContext:    map[string]string{deviceID: "vol-device"},
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  newMountCapability(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"waitforattach vol-device",
+		"mountdevice " + stagingPath + " /dev/fake0",
+	}, driverCalls(t, dir))
+	_, err = os.Stat(stagingPath)
+	assert.NoError(t, err)
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	ns, mounter, dir, cleanup := newFakeNodeServer(t, true)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+	assert.NoError(t, os.Mkdir(stagingPath, 0750))
+	mounter.MountPoints = []mount.MountPoint{{Device: "/dev/fake0", Path: stagingPath}}
+
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err := ns.NodeUnstageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"unmountdevice " + stagingPath,
+		"waitfordetach /dev/fake0",
+	}, driverCalls(t, dir))
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "staging path must be removed")
+
+	// Unstaging again succeeds without calling the driver
+	_, err = ns.NodeUnstageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, driverCalls(t, dir))
+}
+
+func TestNodeUnstageVolumeRetry(t *testing.T) {
+	ns, _, dir, cleanup := newFakeNodeServer(t, true)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		PublishContext:    map[string]string{deviceID: "vol-device"},
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  newMountCapability(),
+	})
+	assert.NoError(t, err)
+	driverCalls(t, dir)
+
+	// waitfordetach fails after unmountdevice removed the staging path
+	busy := filepath.Join(dir, "busy")
+	assert.NoError(t, ioutil.WriteFile(busy, nil, 0600))
+	os.Setenv("DETACHBUSY", busy)
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err = ns.NodeUnstageVolume(context.Background(), req)
+	assert.Error(t, err)
+	assert.Equal(t, []string{
+		"unmountdevice " + stagingPath,
+		"waitfordetach /dev/fake0",
+	}, driverCalls(t, dir))
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "staging path must be removed")
+
+	// The retry still waits for the device recorded at stage time
+	assert.NoError(t, os.Remove(busy))
+	_, err = ns.NodeUnstageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"waitfordetach /dev/fake0"}, driverCalls(t, dir))
+
+	// The device is forgotten once it is detached
+	_, err = ns.NodeUnstageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, driverCalls(t, dir))
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	ns, mounter, dir, cleanup := newFakeNodeServer(t, true)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(stagingPath, 0750))
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  newMountCapability(),
+		Readonly:          true,
+	}
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	mounter.MountPoints = []mount.MountPoint{{Device: "/dev/fake0", Path: stagingPath}}
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, driverCalls(t, dir))
+	// FakeMounter records bind mounts with the device of their source
+	assert.Equal(t, mount.MountPoint{Device: "/dev/fake0", Path: targetPath, Opts: []string{"ro"}}, mounter.MountPoints[1])
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.Empty(t, driverCalls(t, dir))
+	assert.Len(t, mounter.MountPoints, 1)
+	_, err = os.Stat(targetPath)
+	assert.True(t, os.IsNotExist(err), "target path must be removed")
+}
+
+func TestNodePublishVolumeNotAttachable(t *testing.T) {
+	ns, _, dir, cleanup := newFakeNodeServer(t, false)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  newMountCapability(),
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, driverCalls(t, dir))
+
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol",
+		TargetPath:       targetPath,
+		VolumeCapability: newMountCapability(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mount " + targetPath}, driverCalls(t, dir))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unmount " + targetPath}, driverCalls(t, dir))
+}
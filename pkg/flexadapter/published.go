@@ -0,0 +1,213 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexadapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// publishedVolume is a volume attached by ControllerPublishVolume.
+type publishedVolume struct {
+	// volumeName is the name getvolumename reported for the volume. It
+	// identifies the volume in detach calls.
+	volumeName string
+	// fsType, readOnly, volumeContext and secrets make up the options passed
+	// to isattached. secrets are not persisted and missing from volumes
+	// loaded after a restart until they are published again.
+	fsType        string
+	readOnly      bool
+	volumeContext map[string]string
+	secrets       map[string]string
+	// devicePaths maps the nodes the volume is attached to to the device
+	// attach reported.
+	devicePaths map[string]string
+}
+
+// publishedVolumes keeps the volumes attached by the adapter, keyed by
+// volume ID. Every volume is persisted in a file of its own in stateDir, so
+// that the adapter still knows the devices and volume names of the volumes
+// it attached after a restart.
+type publishedVolumes struct {
+	sync.Mutex
+	stateDir string
+	volumes  map[string]*publishedVolume
+}
+
+// publishedVolumeState is the persisted form of a publishedVolume.
+type publishedVolumeState struct {
+	VolumeID      string            `json:"volumeID"`
+	VolumeName    string            `json:"volumeName"`
+	FSType        string            `json:"fsType"`
+	ReadOnly      bool              `json:"readOnly"`
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	DevicePaths   map[string]string `json:"devicePaths"`
+}
+
+// loadPublishedVolumes returns the volumes persisted in stateDir, which is
+// created if it does not exist.
+func loadPublishedVolumes(stateDir string) (*publishedVolumes, error) {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	p := &publishedVolumes{stateDir: stateDir, volumes: map[string]*publishedVolume{}}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var state publishedVolumeState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", file, err)
+		}
+		p.volumes[state.VolumeID] = &publishedVolume{
+			volumeName:    state.VolumeName,
+			fsType:        state.FSType,
+			readOnly:      state.ReadOnly,
+			volumeContext: state.VolumeContext,
+			devicePaths:   state.DevicePaths,
+		}
+	}
+	return p, nil
+}
+
+// get returns a copy of the volume volumeID.
+func (p *publishedVolumes) get(volumeID string) (publishedVolume, bool) {
+	p.Lock()
+	defer p.Unlock()
+	vol, ok := p.volumes[volumeID]
+	if !ok {
+		return publishedVolume{}, false
+	}
+	return vol.copy(), true
+}
+
+// publish records that vol is attached to nodeID at devicePath.
+func (p *publishedVolumes) publish(volumeID, nodeID, devicePath string, vol publishedVolume) error {
+	p.Lock()
+	defer p.Unlock()
+	vol.devicePaths = map[string]string{}
+	if prev, ok := p.volumes[volumeID]; ok {
+		for node, path := range prev.devicePaths {
+			vol.devicePaths[node] = path
+		}
+	}
+	vol.devicePaths[nodeID] = devicePath
+	if err := p.persist(volumeID, &vol); err != nil {
+		return err
+	}
+	p.volumes[volumeID] = &vol
+	return nil
+}
+
+// unpublish forgets that volumeID is attached to nodeID.
+func (p *publishedVolumes) unpublish(volumeID, nodeID string) error {
+	p.Lock()
+	defer p.Unlock()
+	prev, ok := p.volumes[volumeID]
+	if !ok {
+		return nil
+	}
+	vol := prev.copy()
+	delete(vol.devicePaths, nodeID)
+	if len(vol.devicePaths) == 0 {
+		if err := os.Remove(p.stateFile(volumeID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(p.volumes, volumeID)
+		return nil
+	}
+	if err := p.persist(volumeID, &vol); err != nil {
+		return err
+	}
+	p.volumes[volumeID] = &vol
+	return nil
+}
+
+// stateFile returns the file volumeID is persisted in.
+func (p *publishedVolumes) stateFile(volumeID string) string {
+	return filepath.Join(p.stateDir, escapeFileName(volumeID)+".json")
+}
+
+// escapeFileName escapes name for use as a file name.
+func escapeFileName(name string) string {
+	// Escape dots as well so that no name maps to "." or ".."
+	return strings.Replace(url.PathEscape(name), ".", "%2E", -1)
+}
+
+// persist replaces the state file of volumeID atomically, so that a crash
+// never leaves a partial file.
+func (p *publishedVolumes) persist(volumeID string, vol *publishedVolume) error {
+	data, err := json.Marshal(publishedVolumeState{
+		VolumeID:      volumeID,
+		VolumeName:    vol.volumeName,
+		FSType:        vol.fsType,
+		ReadOnly:      vol.readOnly,
+		VolumeContext: vol.volumeContext,
+		DevicePaths:   vol.devicePaths,
+	})
+	if err != nil {
+		return err
+	}
+	file := p.stateFile(volumeID)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// list returns the sorted IDs of the published volumes.
+func (p *publishedVolumes) list() []string {
+	p.Lock()
+	defer p.Unlock()
+	ids := make([]string, 0, len(p.volumes))
+	for id := range p.volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (vol publishedVolume) copy() publishedVolume {
+	devicePaths := make(map[string]string, len(vol.devicePaths))
+	for node, path := range vol.devicePaths {
+		devicePaths[node] = path
+	}
+	vol.devicePaths = devicePaths
+	return vol
+}
+
+// nodes returns the sorted nodes vol is attached to.
+func (vol publishedVolume) nodes() []string {
+	nodes := make([]string, 0, len(vol.devicePaths))
+	for node := range vol.devicePaths {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
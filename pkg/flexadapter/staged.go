@@ -0,0 +1,107 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexadapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stagedDevices keeps the devices waitforattach reported for the volumes
+// staged on this node, keyed by staging path. waitfordetach needs the device
+// after the staging path is unmounted, when it cannot be found in the mount
+// table anymore, so every device is persisted in a file of its own in
+// stateDir until the volume is unstaged.
+type stagedDevices struct {
+	sync.Mutex
+	stateDir string
+}
+
+// stagedDeviceState is the persisted form of a staged device.
+type stagedDeviceState struct {
+	VolumeID    string `json:"volumeID"`
+	StagingPath string `json:"stagingPath"`
+	DevicePath  string `json:"devicePath"`
+}
+
+// newStagedDevices returns the devices persisted in stateDir, which is
+// created if it does not exist.
+func newStagedDevices(stateDir string) (*stagedDevices, error) {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return nil, err
+	}
+	return &stagedDevices{stateDir: stateDir}, nil
+}
+
+// stage records that volumeID is staged at stagingPath from devicePath.
+func (s *stagedDevices) stage(volumeID, stagingPath, devicePath string) error {
+	s.Lock()
+	defer s.Unlock()
+	data, err := json.Marshal(stagedDeviceState{
+		VolumeID:    volumeID,
+		StagingPath: stagingPath,
+		DevicePath:  devicePath,
+	})
+	if err != nil {
+		return err
+	}
+	file := s.stateFile(stagingPath)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// device returns the device staged at stagingPath, or "" if none was
+// recorded.
+func (s *stagedDevices) device(stagingPath string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	file := s.stateFile(stagingPath)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var state stagedDeviceState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", file, err)
+	}
+	return state.DevicePath, nil
+}
+
+// unstage forgets the device staged at stagingPath.
+func (s *stagedDevices) unstage(stagingPath string) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := os.Remove(s.stateFile(stagingPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// stateFile returns the file the device staged at stagingPath is persisted
+// in.
+func (s *stagedDevices) stateFile(stagingPath string) string {
+	return filepath.Join(s.stateDir, escapeFileName(stagingPath)+".json")
+}
@@ -17,10 +17,13 @@ limitations under the License.
 package hostpath
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"math"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
 
 	"github.com/golang/protobuf/ptypes"
@@ -33,18 +36,24 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/sys/unix"
 	utilexec "k8s.io/utils/exec"
 )
 
 const (
 	deviceID           = "deviceID"
-	provisionRoot      = "/tmp/"
-	snapshotRoot       = "/tmp/"
 	maxStorageCapacity = tib
 )
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+	state        *state
+	dataRoot     string
+	snapshotRoot string
+	// statfs is unix.Statfs, replaced in tests.
+	statfs func(path string, buf *unix.Statfs_t) error
+	// usage caches the disk usage of the volumes for totalCapacity.
+	usage *usageCache
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -61,20 +70,30 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	var accessTypeBlock, accessTypeMount bool
 	for _, cap := range caps {
 		if cap.GetBlock() != nil {
-			return nil, status.Error(codes.Unimplemented, "Block Volume not supported")
+			accessTypeBlock = true
+		}
+		if cap.GetMount() != nil {
+			accessTypeMount = true
 		}
 	}
 	// A real driver would also need to check that the other
-	// fields in VolumeCapabilities are sane. The check above is
-	// just enough to pass the "[Testpattern: Dynamic PV (block
-	// volmode)] volumeMode should fail in binding dynamic
-	// provisioned PV to PVC" storage E2E test.
+	// fields in VolumeCapabilities are sane.
+	if accessTypeBlock && accessTypeMount {
+		return nil, status.Error(codes.InvalidArgument, "Cannot have both block and mount access type")
+	}
+
+	// Concurrent requests for the same name must not create two volumes
+	if err := cs.state.beginCreateVolume(req.GetName()); err != nil {
+		return nil, err
+	}
+	defer cs.state.endCreateVolume(req.GetName())
 
 	// Need to check for already existing volume name, and if found
 	// check for the requested capacity and already allocated capacity
-	if exVol, err := getVolumeByName(req.GetName()); err == nil {
+	if exVol, err := cs.state.getVolumeByName(req.GetName()); err == nil {
 		// Since err is nil, it means the volume with the same name already exists
 		// need to check if the size of exisiting volume is the same as in new
 		// request
@@ -91,54 +110,140 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Volume with the same name: %s but with different size already exist", req.GetName()))
 	}
+	mode := req.GetParameters()[paramProvisioningMode]
+	if mode == "" {
+		mode = provisioningModeDirectory
+	}
+	if mode != provisioningModeDirectory && mode != provisioningModeLoopback {
+		return nil, status.Errorf(codes.InvalidArgument, "Unsupported %s %q", paramProvisioningMode, mode)
+	}
+	if mode == provisioningModeLoopback && req.GetVolumeContentSource() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume content source is not supported with %s %q", paramProvisioningMode, mode)
+	}
+	if accessTypeBlock {
+		if req.GetVolumeContentSource() != nil {
+			return nil, status.Error(codes.InvalidArgument, "Volume content source is not supported for block volumes")
+		}
+		mode = volTypeBlock
+	}
 	// Check for maximum available capacity
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
+	if mode != provisioningModeDirectory && capacity == 0 {
+		capacity = defaultImageSize
+	}
+	if source := req.GetVolumeContentSource().GetVolume(); source != nil {
+		srcVol, err := cs.state.getVolumeByID(source.GetVolumeId())
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		if srcVol.VolType != "" && srcVol.VolType != provisioningModeDirectory {
+			return nil, status.Errorf(codes.InvalidArgument, "Cloning is not supported for %s volume %s", srcVol.VolType, srcVol.VolID)
+		}
+		if capacity == 0 {
+			capacity = srcVol.VolSize
+		}
+		if capacity < srcVol.VolSize {
+			return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d is smaller than source volume %s capacity %d", capacity, srcVol.VolID, srcVol.VolSize)
+		}
+	}
 	if capacity >= maxStorageCapacity {
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, maxStorageCapacity)
 	}
-	volumeID := uuid.NewUUID().String()
-	path := provisionRoot + volumeID
-	err := os.MkdirAll(path, 0777)
+	total, err := cs.totalCapacity()
 	if err != nil {
-		glog.V(3).Infof("failed to create volume: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := cs.state.reserveCapacity(req.GetName(), capacity, total); err != nil {
 		return nil, err
 	}
-	if req.GetVolumeContentSource() != nil {
-		contentSource := req.GetVolumeContentSource()
-		if contentSource.GetSnapshot() != nil {
-			snapshotId := contentSource.GetSnapshot().GetSnapshotId()
-			snapshot, ok := hostPathVolumeSnapshots[snapshotId]
-			if !ok {
-				return nil, status.Errorf(codes.NotFound, "cannot find snapshot %v", snapshotId)
-			}
-			if snapshot.ReadyToUse != true {
-				return nil, status.Errorf(codes.Internal, "Snapshot %v is not yet ready to use.", snapshotId)
-			}
-			snapshotPath := snapshot.Path
-			args := []string{"zxvf", snapshotPath, "-C", path}
-			executor := utilexec.New()
-			out, err := executor.Command("tar", args...).CombinedOutput()
-			if err != nil {
-				return nil, status.Error(codes.Internal, fmt.Sprintf("failed pre-populate data for volume: %v: %s", err, out))
-			}
+	volumeID := uuid.NewUUID().String()
+	var path, fsType string
+	switch mode {
+	case provisioningModeLoopback:
+		fsType = getFsType(caps)
+		path = filepath.Join(cs.dataRoot, volumeID+".img")
+		if err := createImage(path, capacity, fsType); err != nil {
+			glog.V(3).Infof("failed to create volume: %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	case volTypeBlock:
+		path = filepath.Join(cs.dataRoot, volumeID+".img")
+		if err := createImage(path, capacity, ""); err != nil {
+			glog.V(3).Infof("failed to create volume: %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	default:
+		path = filepath.Join(cs.dataRoot, volumeID)
+		err = os.MkdirAll(path, 0777)
+		if err != nil {
+			glog.V(3).Infof("failed to create volume: %v", err)
+			return nil, err
 		}
 	}
+	// Do not leave a half populated volume behind
+	if err := cs.populateVolume(path, req.GetVolumeContentSource()); err != nil {
+		os.RemoveAll(path)
+		return nil, err
+	}
 	glog.V(4).Infof("create volume %s", path)
 	hostPathVol := hostPathVolume{}
 	hostPathVol.VolName = req.GetName()
 	hostPathVol.VolID = volumeID
 	hostPathVol.VolSize = capacity
 	hostPathVol.VolPath = path
-	hostPathVolumes[volumeID] = hostPathVol
+	hostPathVol.VolType = mode
+	hostPathVol.FsType = fsType
+	if err := cs.state.addVolume(hostPathVol); err != nil {
+		os.RemoveAll(path)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
-			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			CapacityBytes: capacity,
 			VolumeContext: req.GetParameters(),
+			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
 
+// populateVolume copies the contents of the snapshot or volume source into
+// the volume at path.
+func (cs *controllerServer) populateVolume(path string, source *csi.VolumeContentSource) error {
+	if snapshotSource := source.GetSnapshot(); snapshotSource != nil {
+		snapshotId := snapshotSource.GetSnapshotId()
+		snapshot, err := cs.state.getSnapshotByID(snapshotId)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "cannot find snapshot %v", snapshotId)
+		}
+		if snapshot.ReadyToUse != true {
+			return status.Errorf(codes.Unavailable, "Snapshot %v is not yet ready to use, %s", snapshotId, cs.describeSnapshotProgress(snapshotId))
+		}
+		snapshotPath := snapshot.Path
+		args := []string{"zxvf", snapshotPath, "-C", path}
+		executor := utilexec.New()
+		out, err := executor.Command("tar", args...).CombinedOutput()
+		if err != nil {
+			return status.Error(codes.Internal, fmt.Sprintf("failed pre-populate data for volume: %v: %s", err, out))
+		}
+	}
+	if volumeSource := source.GetVolume(); volumeSource != nil {
+		srcVol, err := cs.state.getVolumeByID(volumeSource.GetVolumeId())
+		if err != nil {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		// cp -a keeps ownership, permissions, timestamps, xattrs and
+		// symlinks of the source tree.
+		args := []string{"-a", srcVol.VolPath + "/.", path + "/"}
+		executor := utilexec.New()
+		out, err := executor.Command("cp", args...).CombinedOutput()
+		if err != nil {
+			return status.Error(codes.Internal, fmt.Sprintf("failed to clone volume %s: %v: %s", srcVol.VolID, err, out))
+		}
+	}
+	return nil
+}
+
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 
 	// Check arguments
@@ -152,18 +257,148 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	}
 	volumeID := req.VolumeId
 	glog.V(4).Infof("deleting volume %s", volumeID)
-	path := provisionRoot + volumeID
+	path := filepath.Join(cs.dataRoot, volumeID)
+	if vol, err := cs.state.getVolumeByID(volumeID); err == nil {
+		path = vol.VolPath
+		if vol.VolType == volTypeBlock {
+			if err := detachLoopDevices(path); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+	// The volume is dropped from the state first, which fails while a
+	// snapshot of it is being archived
+	if err := cs.state.deleteVolume(volumeID); err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	os.RemoveAll(path)
-	delete(hostPathVolumes, volumeID)
+	cs.usage.forget(volumeID)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		glog.V(3).Infof("invalid list volumes req: %v", req)
+		return nil, err
+	}
+
+	var volumes []csi.Volume
+	for _, vol := range cs.state.listVolumes() {
+		volume := csi.Volume{
+			VolumeId:      vol.VolID,
+			CapacityBytes: vol.VolSize,
+		}
+		volumes = append(volumes, volume)
+	}
+
+	var (
+		ulenVolumes   = int32(len(volumes))
+		maxEntries    = req.MaxEntries
+		startingToken int32
+	)
+
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "maxEntries=%d < 0", maxEntries)
+	}
+
+	if v := req.StartingToken; v != "" {
+		i, err := strconv.ParseUint(v, 10, 31)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Aborted,
+				"startingToken=%q is not a valid token",
+				v)
+		}
+		startingToken = int32(i)
+	}
+
+	if startingToken > ulenVolumes {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"startingToken=%d > len(volumes)=%d",
+			startingToken, ulenVolumes)
+	}
+
+	// Discern the number of remaining entries.
+	rem := ulenVolumes - startingToken
+
+	// If maxEntries is 0 or greater than the number of remaining entries then
+	// set maxEntries to the number of remaining entries.
+	if maxEntries == 0 || maxEntries > rem {
+		maxEntries = rem
+	}
+
+	var (
+		i       int
+		j       = startingToken
+		entries = make(
+			[]*csi.ListVolumesResponse_Entry,
+			maxEntries)
+	)
+
+	for i = 0; i < len(entries); i++ {
+		entries[i] = &csi.ListVolumesResponse_Entry{
+			Volume: &volumes[j],
+		}
+		j++
+	}
+
+	var nextToken string
+	if j < ulenVolumes {
+		nextToken = fmt.Sprintf("%d", j)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		glog.V(3).Infof("invalid get capacity req: %v", req)
+		return nil, err
+	}
+
+	total, err := cs.totalCapacity()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	available := total - cs.state.allocatedCapacity()
+	if available < 0 {
+		available = 0
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+	}, nil
+}
+
+// totalCapacity returns the capacity volumes are allocated out of: the space
+// available on the filesystem backing the data root plus the space the
+// volumes already use on it.
+func (cs *controllerServer) totalCapacity() (int64, error) {
+	var statfs unix.Statfs_t
+	if err := cs.statfs(cs.dataRoot, &statfs); err != nil {
+		return 0, fmt.Errorf("failed to statfs %s: %v", cs.dataRoot, err)
+	}
+	used, err := cs.usage.total(cs.state.listVolumes())
+	if err != nil {
+		return 0, err
+	}
+	return int64(statfs.Bavail)*int64(statfs.Frsize) + used, nil
+}
+
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	return cs.DefaultControllerServer.ValidateVolumeCapabilities(ctx, req)
 }
 
 // CreateSnapshot uses tar command to create snapshot for hostpath volume. The tar command can quickly create
 // archives of entire directories. The host image must have "tar" binaries in /bin, /usr/sbin, or /usr/bin.
+// The archive is written in the background; the snapshot is reported as not ready to use until it is complete.
 func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
 		glog.V(3).Infof("invalid create snapshot req: %v", req)
@@ -178,13 +413,22 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
 	}
 
+	// Concurrent requests for the same name must not create two snapshots
+	if err := cs.state.beginCreateSnapshot(req.GetName()); err != nil {
+		return nil, err
+	}
+	defer cs.state.endCreateSnapshot(req.GetName())
+
 	// Need to check for already existing snapshot name, and if found check for the
 	// requested sourceVolumeId and sourceVolumeId of snapshot that has been created.
-	if exSnap, err := getSnapshotByName(req.GetName()); err == nil {
+	if exSnap, err := cs.state.getSnapshotByName(req.GetName()); err == nil {
 		// Since err is nil, it means the snapshot with the same name already exists need
 		// to check if the sourceVolumeId of existing snapshot is the same as in new request.
 		if exSnap.VolID == req.GetSourceVolumeId() {
 			// same snapshot has been created.
+			if !exSnap.ReadyToUse {
+				glog.V(4).Infof("snapshot %s is not ready yet, %s", exSnap.Id, cs.describeSnapshotProgress(exSnap.Id))
+			}
 			return &csi.CreateSnapshotResponse{
 				Snapshot: &csi.Snapshot{
 					SnapshotId:     exSnap.Id,
@@ -199,21 +443,17 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}
 
 	volumeID := req.GetSourceVolumeId()
-	hostPathVolume, ok := hostPathVolumes[volumeID]
-	if !ok {
+	hostPathVolume, err := cs.state.getVolumeByID(volumeID)
+	if err != nil {
 		return nil, status.Error(codes.Internal, "volumeID is not exist")
 	}
+	if hostPathVolume.VolType == provisioningModeLoopback || hostPathVolume.VolType == volTypeBlock {
+		return nil, status.Errorf(codes.InvalidArgument, "Snapshots are not supported for %s %q", paramProvisioningMode, hostPathVolume.VolType)
+	}
 
 	snapshotID := uuid.NewUUID().String()
 	creationTime := ptypes.TimestampNow()
-	volPath := hostPathVolume.VolPath
-	file := snapshotRoot + snapshotID + ".tgz"
-	args := []string{"czf", file, "-C", volPath, "."}
-	executor := utilexec.New()
-	out, err := executor.Command("tar", args...).CombinedOutput()
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("failed create snapshot: %v: %s", err, out))
-	}
+	file := filepath.Join(cs.snapshotRoot, snapshotID+".tgz")
 
 	glog.V(4).Infof("create volume snapshot %s", file)
 	snapshot := hostPathSnapshot{}
@@ -223,9 +463,15 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	snapshot.Path = file
 	snapshot.CreationTime = *creationTime
 	snapshot.SizeBytes = hostPathVolume.VolSize
-	snapshot.ReadyToUse = true
+	snapshot.ReadyToUse = false
 
-	hostPathVolumeSnapshots[snapshotID] = snapshot
+	if err := cs.state.addSnapshot(snapshot); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	go cs.cutSnapshot(snapshot, hostPathVolume.VolPath)
 
 	return &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
@@ -250,9 +496,11 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 	}
 	snapshotID := req.GetSnapshotId()
 	glog.V(4).Infof("deleting volume %s", snapshotID)
-	path := snapshotRoot + snapshotID + ".tgz"
+	path := filepath.Join(cs.snapshotRoot, snapshotID+".tgz")
 	os.RemoveAll(path)
-	delete(hostPathVolumeSnapshots, snapshotID)
+	if err := cs.state.deleteSnapshot(snapshotID); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
@@ -265,14 +513,16 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 	// case 1: SnapshotId is not empty, return snapshots that match the snapshot id.
 	if len(req.GetSnapshotId()) != 0 {
 		snapshotID := req.SnapshotId
-		if snapshot, ok := hostPathVolumeSnapshots[snapshotID]; ok {
+		if snapshot, err := cs.state.getSnapshotByID(snapshotID); err == nil {
 			return convertSnapshot(snapshot), nil
 		}
 	}
 
+	allSnapshots := cs.state.listSnapshots()
+
 	// case 2: SourceVolumeId is not empty, return snapshots that match the source volume id.
 	if len(req.GetSourceVolumeId()) != 0 {
-		for _, snapshot := range hostPathVolumeSnapshots {
+		for _, snapshot := range allSnapshots {
 			if snapshot.VolID == req.SourceVolumeId {
 				return convertSnapshot(snapshot), nil
 			}
@@ -281,14 +531,11 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 
 	var snapshots []csi.Snapshot
 	// case 3: no parameter is set, so we return all the snapshots.
-	sortedKeys := make([]string, 0)
-	for k := range hostPathVolumeSnapshots {
-		sortedKeys = append(sortedKeys, k)
-	}
-	sort.Strings(sortedKeys)
-
-	for _, key := range sortedKeys {
-		snap := hostPathVolumeSnapshots[key]
+	for _, snap := range allSnapshots {
+		snap := snap
+		if !snap.ReadyToUse {
+			glog.V(4).Infof("snapshot %s is not ready yet, %s", snap.Id, cs.describeSnapshotProgress(snap.Id))
+		}
 		snapshot := csi.Snapshot{
 			SnapshotId:     snap.Id,
 			SourceVolumeId: snap.VolID,
@@ -358,6 +605,116 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 	}, nil
 }
 
+// cutSnapshot archives volPath into the snapshot file and marks the snapshot
+// ready to use once the archive is complete. A failed snapshot is dropped so
+// that the next CreateSnapshot call with the same name starts over. The
+// progress of the archive is tracked in the state.
+func (cs *controllerServer) cutSnapshot(snapshot hostPathSnapshot, volPath string) {
+	glog.V(4).Infof("cutting snapshot %s of volume %s", snapshot.Id, snapshot.VolID)
+	total, err := apparentSize(volPath)
+	if err != nil {
+		glog.Warningf("failed to estimate the size of snapshot %s: %v", snapshot.Id, err)
+	}
+	progress := cs.state.startSnapshotJob(snapshot.Id, total)
+
+	err = archive(snapshot.Path, volPath, progress)
+	if err != nil {
+		glog.Errorf("failed create snapshot %s: %v", snapshot.Id, err)
+	} else {
+		glog.V(4).Infof("snapshot %s is ready to use", snapshot.Id)
+	}
+
+	found, saveErr := cs.state.completeSnapshot(snapshot.Id, err == nil)
+	if !found {
+		// The snapshot was deleted while the archive was being written.
+		os.RemoveAll(snapshot.Path)
+	}
+	if saveErr != nil {
+		glog.Errorf("failed to persist snapshot %s: %v", snapshot.Id, saveErr)
+	}
+}
+
+// archive writes the contents of dir to the gzipped tarball file. The
+// uncompressed tar stream is counted by progress.
+func archive(file, dir string, progress *snapshotProgress) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+
+	var stderr bytes.Buffer
+	cmd := utilexec.New().Command("tar", "cf", "-", "-C", dir, ".")
+	cmd.SetStdout(io.MultiWriter(gz, progress))
+	cmd.SetStderr(&stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, stderr.Bytes())
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// describeSnapshotProgress describes how far the archive of the snapshot
+// snapshotID has been written. The CSI version implemented has no field to
+// report it in, so it is logged and returned in errors.
+func (cs *controllerServer) describeSnapshotProgress(snapshotID string) string {
+	progress, ok := cs.state.getSnapshotProgress(snapshotID)
+	if !ok {
+		return "archive pending"
+	}
+	return fmt.Sprintf("%d%% archived", progress.percent())
+}
+
+// apparentSize returns the size of the files below path, which is roughly
+// the size of their tar archive.
+func apparentSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// resumeSnapshots restarts the archive jobs of snapshots which were not ready
+// to use when the driver was stopped.
+func (cs *controllerServer) resumeSnapshots() {
+	for _, snapshot := range cs.state.listSnapshots() {
+		if snapshot.ReadyToUse {
+			continue
+		}
+		vol, err := cs.state.getVolumeByID(snapshot.VolID)
+		if err != nil {
+			glog.Warningf("dropping snapshot %s: source volume %s no longer exists", snapshot.Id, snapshot.VolID)
+			os.RemoveAll(snapshot.Path)
+			if err := cs.state.deleteSnapshot(snapshot.Id); err != nil {
+				glog.Errorf("failed to persist snapshots: %v", err)
+			}
+			continue
+		}
+		go cs.cutSnapshot(snapshot, vol.VolPath)
+	}
+}
+
+// getFsType returns the filesystem requested by the mount capabilities, or
+// defaultFsType if none was given.
+func getFsType(caps []*csi.VolumeCapability) string {
+	for _, cap := range caps {
+		if fsType := cap.GetMount().GetFsType(); fsType != "" {
+			return fsType
+		}
+	}
+	return defaultFsType
+}
+
 func convertSnapshot(snap hostPathSnapshot) *csi.ListSnapshotsResponse {
 	entries := []*csi.ListSnapshotsResponse_Entry{
 		{
@@ -0,0 +1,384 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/sys/unix"
+)
+
+func newFakeControllerServer(t *testing.T) (*controllerServer, func()) {
+	dir, err := ioutil.TempDir("", "hostpath-controller")
+	assert.NoError(t, err)
+
+	d := csicommon.NewCSIDriver("fake", "1.0.0", "fakeNodeID")
+	d.AddControllerServiceCapabilities(
+		[]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		})
+	st, err := loadState(dir)
+	assert.NoError(t, err)
+
+	return NewControllerServer(d, st, dir, dir), func() { os.RemoveAll(dir) }
+}
+
+func newCreateVolumeRequest(name string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: mib},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+}
+
+func TestConcurrentCreateVolumeSameName(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		ids = map[string]bool{}
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("same"))
+			if err != nil {
+				// Losing the race is reported as Aborted so the caller retries.
+				assert.Equal(t, codes.Aborted, status.Code(err))
+				return
+			}
+			mu.Lock()
+			ids[resp.GetVolume().GetVolumeId()] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, ids, 1)
+	assert.Len(t, cs.state.listVolumes(), 1)
+}
+
+func TestConcurrentCreateDeleteVolumes(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(fmt.Sprintf("vol-%d", i)))
+			assert.NoError(t, err)
+			_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+			assert.NoError(t, err)
+			if i%2 == 0 {
+				_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.GetEntries(), 10)
+}
+
+func TestListVolumesPagination(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(fmt.Sprintf("vol-%d", i)))
+		assert.NoError(t, err)
+		ids = append(ids, resp.GetVolume().GetVolumeId())
+	}
+	// Volumes are listed by ID
+	sort.Strings(ids)
+
+	testCases := []struct {
+		name          string
+		startingToken string
+		maxEntries    int32
+		expectedCode  codes.Code
+		expectedIDs   []string
+		expectedToken string
+	}{
+		{name: "all", expectedIDs: ids},
+		{name: "first page", maxEntries: 2, expectedIDs: ids[:2], expectedToken: "2"},
+		{name: "middle page", startingToken: "2", maxEntries: 2, expectedIDs: ids[2:4], expectedToken: "4"},
+		{name: "last page", startingToken: "4", maxEntries: 2, expectedIDs: ids[4:]},
+		{name: "max entries exceeding the rest", startingToken: "3", maxEntries: 10, expectedIDs: ids[3:]},
+		{name: "token at end", startingToken: "5"},
+		{name: "token past end", startingToken: "6", expectedCode: codes.Aborted},
+		{name: "token not a number", startingToken: "abc", expectedCode: codes.Aborted},
+		{name: "negative token", startingToken: "-1", expectedCode: codes.Aborted},
+		{name: "negative max entries", maxEntries: -1, expectedCode: codes.InvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{
+				StartingToken: tc.startingToken,
+				MaxEntries:    tc.maxEntries,
+			})
+			assert.Equal(t, tc.expectedCode, status.Code(err))
+			if err != nil {
+				if tc.startingToken != "" {
+					// The rejected token is reported
+					assert.Contains(t, status.Convert(err).Message(), tc.startingToken)
+				}
+				return
+			}
+			var listed []string
+			for _, e := range resp.GetEntries() {
+				assert.Equal(t, mib, e.GetVolume().GetCapacityBytes())
+				listed = append(listed, e.GetVolume().GetVolumeId())
+			}
+			assert.Equal(t, tc.expectedIDs, listed)
+			assert.Equal(t, tc.expectedToken, resp.GetNextToken())
+		})
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+	// The data root has 100 MiB available in fragments of 1 MiB. The block
+	// size differs to catch it being used instead of the fragment size.
+	cs.statfs = func(path string, buf *unix.Statfs_t) error {
+		*buf = unix.Statfs_t{Bsize: 4 * mib, Frsize: mib, Blocks: 1000, Bfree: 200, Bavail: 100}
+		return nil
+	}
+
+	resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 100*mib, resp.GetAvailableCapacity())
+
+	// Volumes take their full size from the available capacity, although
+	// they hardly use any space yet
+	req := newCreateVolumeRequest("vol")
+	req.CapacityRange.RequiredBytes = 10 * mib
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	resp, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	assert.NoError(t, err)
+	assert.InDelta(t, 90*mib, resp.GetAvailableCapacity(), float64(mib))
+
+	req = newCreateVolumeRequest("too-large")
+	req.CapacityRange.RequiredBytes = 95 * mib
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	req.CapacityRange.RequiredBytes = maxStorageCapacity
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// Failed requests do not keep their reservation
+	resp, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	assert.NoError(t, err)
+	assert.InDelta(t, 90*mib, resp.GetAvailableCapacity(), float64(mib))
+}
+
+// waitForSnapshot waits until the snapshot snapshotID is ready to use.
+func waitForSnapshot(t *testing.T, cs *controllerServer, snapshotID string) {
+	for i := 0; i < 100; i++ {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+		assert.NoError(t, err)
+		if len(resp.GetEntries()) == 1 && resp.GetEntries()[0].GetSnapshot().GetReadyToUse() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("snapshot %s did not become ready to use", snapshotID)
+}
+
+func TestSnapshots(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("src"))
+	assert.NoError(t, err)
+	srcID := resp.GetVolume().GetVolumeId()
+	src, err := cs.state.getVolumeByID(srcID)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src.VolPath, "data"), []byte("hello"), 0644))
+
+	// The archive is written in the background
+	snapReq := &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: srcID}
+	snapResp, err := cs.CreateSnapshot(context.Background(), snapReq)
+	assert.NoError(t, err)
+	assert.False(t, snapResp.GetSnapshot().GetReadyToUse())
+	snapshotID := snapResp.GetSnapshot().GetSnapshotId()
+	waitForSnapshot(t, cs, snapshotID)
+
+	// Creating the snapshot again returns the same snapshot
+	snapResp, err = cs.CreateSnapshot(context.Background(), snapReq)
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotID, snapResp.GetSnapshot().GetSnapshotId())
+	assert.True(t, snapResp.GetSnapshot().GetReadyToUse())
+
+	restoreReq := newCreateVolumeRequest("restored")
+	restoreReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	}
+	resp, err = cs.CreateVolume(context.Background(), restoreReq)
+	assert.NoError(t, err)
+	restored, err := cs.state.getVolumeByID(resp.GetVolume().GetVolumeId())
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(restored.VolPath, "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestSnapshotsResume(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("src"))
+	assert.NoError(t, err)
+	srcID := resp.GetVolume().GetVolumeId()
+
+	// The driver stopped before the archive of the snapshot was written
+	snapshot := hostPathSnapshot{Name: "snap", Id: "snap-id", VolID: srcID, Path: filepath.Join(cs.snapshotRoot, "snap-id.tgz")}
+	assert.NoError(t, cs.state.addSnapshot(snapshot))
+
+	// The source volume cannot be deleted until the snapshot is ready
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: srcID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = os.Stat(cs.state.volumes[srcID].VolPath)
+	assert.NoError(t, err)
+
+	// Volumes cannot be restored from it yet
+	restoreReq := newCreateVolumeRequest("restored")
+	restoreReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-id"},
+		},
+	}
+	_, err = cs.CreateVolume(context.Background(), restoreReq)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// The driver restarts and finishes the snapshot
+	st, err := loadState(cs.dataRoot)
+	assert.NoError(t, err)
+	cs = NewControllerServer(cs.Driver, st, cs.dataRoot, cs.snapshotRoot)
+	cs.resumeSnapshots()
+	waitForSnapshot(t, cs, "snap-id")
+
+	_, err = cs.CreateVolume(context.Background(), restoreReq)
+	assert.NoError(t, err)
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: srcID})
+	assert.NoError(t, err)
+}
+
+// volumeDirs returns the directories below the data root of cs.
+func volumeDirs(t *testing.T, cs *controllerServer) []string {
+	files, err := ioutil.ReadDir(cs.dataRoot)
+	assert.NoError(t, err)
+	var dirs []string
+	for _, f := range files {
+		if f.IsDir() {
+			dirs = append(dirs, f.Name())
+		}
+	}
+	return dirs
+}
+
+func TestCreateVolumeContentSourceErrors(t *testing.T) {
+	cs, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	req := newCreateVolumeRequest("src")
+	req.CapacityRange.RequiredBytes = 2 * mib
+	resp, err := cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	srcID := resp.GetVolume().GetVolumeId()
+	assert.NoError(t, cs.state.addSnapshot(hostPathSnapshot{Name: "pending", Id: "pending-id", VolID: srcID}))
+
+	volumeSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: id},
+			},
+		}
+	}
+	snapshotSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: id},
+			},
+		}
+	}
+	testCases := []struct {
+		name         string
+		source       *csi.VolumeContentSource
+		capacity     int64
+		expectedCode codes.Code
+	}{
+		{name: "unknown source volume", source: volumeSource("unknown"), capacity: 2 * mib, expectedCode: codes.NotFound},
+		{name: "source volume too large", source: volumeSource(srcID), capacity: mib, expectedCode: codes.OutOfRange},
+		{name: "unknown snapshot", source: snapshotSource("unknown"), capacity: 2 * mib, expectedCode: codes.NotFound},
+		{name: "snapshot not ready", source: snapshotSource("pending-id"), capacity: 2 * mib, expectedCode: codes.Unavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newCreateVolumeRequest("vol")
+			req.CapacityRange.RequiredBytes = tc.capacity
+			req.VolumeContentSource = tc.source
+			_, err := cs.CreateVolume(context.Background(), req)
+			assert.Equal(t, tc.expectedCode, status.Code(err))
+			// Nothing is left behind
+			assert.Equal(t, []string{srcID}, volumeDirs(t, cs))
+			assert.Len(t, cs.state.listVolumes(), 1)
+		})
+	}
+}
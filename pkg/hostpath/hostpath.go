@@ -18,12 +18,16 @@ package hostpath
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 
 	timestamp "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
 const (
@@ -42,6 +46,8 @@ type hostPath struct {
 	ns  *nodeServer
 	cs  *controllerServer
 
+	state *state
+
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 }
@@ -51,6 +57,11 @@ type hostPathVolume struct {
 	VolID   string `json:"volID"`
 	VolSize int64  `json:"volSize"`
 	VolPath string `json:"volPath"`
+	VolType string `json:"volType"`
+	FsType  string `json:"fsType,omitempty"`
+	// PublishedTargets lists the target paths a block volume is published
+	// at. Its loop device is released when the last one is unpublished.
+	PublishedTargets []string `json:"publishedTargets,omitempty"`
 }
 
 type hostPathSnapshot struct {
@@ -63,19 +74,11 @@ type hostPathSnapshot struct {
 	ReadyToUse   bool                `json:"readyToUse"`
 }
 
-var hostPathVolumes map[string]hostPathVolume
-var hostPathVolumeSnapshots map[string]hostPathSnapshot
-
 var (
 	hostPathDriver *hostPath
 	vendorVersion  = "dev"
 )
 
-func init() {
-	hostPathVolumes = map[string]hostPathVolume{}
-	hostPathVolumeSnapshots = map[string]hostPathSnapshot{}
-}
-
 func GetHostPathDriver() *hostPath {
 	return &hostPath{}
 }
@@ -86,66 +89,101 @@ func NewIdentityServer(d *csicommon.CSIDriver) *identityServer {
 	}
 }
 
-func NewControllerServer(d *csicommon.CSIDriver) *controllerServer {
+func NewControllerServer(d *csicommon.CSIDriver, st *state, dataDir, snapshotDir string) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
+		state:                   st,
+		dataRoot:                dataDir,
+		snapshotRoot:            snapshotDir,
+		statfs:                  unix.Statfs,
+		usage:                   newUsageCache(usageCacheTTL),
 	}
 }
 
-func NewNodeServer(d *csicommon.CSIDriver) *nodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, st *state, dataDir string) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		state:             st,
+		dataRoot:          dataDir,
+		mounter:           mount.New(""),
 	}
 }
 
-func (hp *hostPath) Run(driverName, nodeID, endpoint string) {
+func (hp *hostPath) Run(driverName, nodeID, endpoint, dataDir, snapshotDir, stateDir string) {
 	glog.Infof("Driver: %v ", driverName)
 	glog.Infof("Version: %s", vendorVersion)
 
+	// Volumes and snapshots are created below these directories
+	for _, dir := range []string{dataDir, snapshotDir} {
+		if err := validateDir(dir); err != nil {
+			glog.Fatalf("Invalid directory: %v", err)
+		}
+	}
+
+	// Restore volumes and snapshots from a previous run
+	var err error
+	hp.state, err = loadState(stateDir)
+	if err != nil {
+		glog.Fatalf("Failed to load driver state: %v", err)
+	}
+
 	// Initialize default library driver
-	hp.driver = csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
+	hp.driver = newCSIDriver(driverName, nodeID)
 	if hp.driver == nil {
 		glog.Fatalln("Failed to initialize CSI Driver.")
 	}
-	hp.driver.AddControllerServiceCapabilities(
-		[]csi.ControllerServiceCapability_RPC_Type{
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
-		})
-	hp.driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
 	// Create GRPC servers
 	hp.ids = NewIdentityServer(hp.driver)
-	hp.ns = NewNodeServer(hp.driver)
-	hp.cs = NewControllerServer(hp.driver)
+	hp.ns = NewNodeServer(hp.driver, hp.state, dataDir)
+	hp.cs = NewControllerServer(hp.driver, hp.state, dataDir, snapshotDir)
+
+	// Finish snapshots which were interrupted by a restart
+	hp.cs.resumeSnapshots()
 
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(endpoint, hp.ids, hp.cs, hp.ns)
 	s.Wait()
 }
 
-func getVolumeByID(volumeID string) (hostPathVolume, error) {
-	if hostPathVol, ok := hostPathVolumes[volumeID]; ok {
-		return hostPathVol, nil
+// newCSIDriver returns the library driver with the capabilities of the
+// hostpath driver.
+func newCSIDriver(driverName, nodeID string) *csicommon.CSIDriver {
+	d := csicommon.NewCSIDriver(driverName, vendorVersion, nodeID)
+	if d == nil {
+		return nil
 	}
-	return hostPathVolume{}, fmt.Errorf("volume id %s does not exit in the volumes list", volumeID)
+	d.AddControllerServiceCapabilities(
+		[]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		})
+	d.AddNodeServiceCapabilities(
+		[]csi.NodeServiceCapability_RPC_Type{
+			csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		})
+	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	return d
 }
 
-func getVolumeByName(volName string) (hostPathVolume, error) {
-	for _, hostPathVol := range hostPathVolumes {
-		if hostPathVol.VolName == volName {
-			return hostPathVol, nil
-		}
+// validateDir checks that dir is an existing directory the driver can create
+// files in.
+func validateDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
 	}
-	return hostPathVolume{}, fmt.Errorf("volume name %s does not exit in the volumes list", volName)
-}
-
-func getSnapshotByName(name string) (hostPathSnapshot, error) {
-	for _, snapshot := range hostPathVolumeSnapshots {
-		if snapshot.Name == name {
-			return snapshot, nil
-		}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".csi-hostpath-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
 	}
-	return hostPathSnapshot{}, fmt.Errorf("snapshot name %s does not exit in the snapshots list", name)
+	f.Close()
+	return os.Remove(f.Name())
 }
@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-dir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0600))
+	readOnly := filepath.Join(dir, "read-only")
+	assert.NoError(t, os.Mkdir(readOnly, 0500))
+
+	tests := []struct {
+		name  string
+		dir   string
+		valid bool
+	}{
+		{
+			name:  "directory",
+			dir:   dir,
+			valid: true,
+		},
+		{
+			name: "missing",
+			dir:  filepath.Join(dir, "missing"),
+		},
+		{
+			name: "not a directory",
+			dir:  file,
+		},
+		{
+			name: "read-only directory",
+			dir:  readOnly,
+		},
+		{
+			// Not writable even for root
+			name: "proc",
+			dir:  "/proc",
+		},
+	}
+
+	for _, test := range tests {
+		if test.dir == readOnly && os.Geteuid() == 0 {
+			// Permissions do not apply to root
+			continue
+		}
+		err := validateDir(test.dir)
+		if test.valid {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+
+	// No files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
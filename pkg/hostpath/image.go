@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// paramProvisioningMode is the StorageClass parameter selecting how
+	// volumes are backed on disk.
+	paramProvisioningMode = "provisioningMode"
+
+	// provisioningModeDirectory backs a volume by a plain directory. This
+	// is the default and does not enforce the volume size.
+	provisioningModeDirectory = "directory"
+	// provisioningModeLoopback backs a volume by a sparse image file of the
+	// requested size which is formatted and loop-mounted on publish.
+	provisioningModeLoopback = "loopback"
+
+	// volTypeBlock marks a raw block volume. It is backed by an unformatted
+	// image file which is attached to a loop device on publish.
+	volTypeBlock = "block"
+
+	defaultFsType    = "ext4"
+	defaultImageSize = gib
+)
+
+// createImage allocates a sparse file of the given size at path and formats
+// it with fsType. An empty fsType leaves the image unformatted.
+func createImage(path string, size int64, fsType string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create image %s: %v", path, err)
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to allocate %d bytes for image %s: %v", size, path, err)
+	}
+	if fsType == "" {
+		return nil
+	}
+
+	args := []string{path}
+	if fsType == "ext4" || fsType == "ext3" {
+		args = []string{"-F", "-m0", path}
+	}
+	glog.V(4).Infof("formatting image %s with %s", path, fsType)
+	executor := utilexec.New()
+	out, err := executor.Command("mkfs."+fsType, args...).CombinedOutput()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to format image %s with %s: %v: %s", path, fsType, err, out)
+	}
+	return nil
+}
+
+// attachLoopDevice returns the loop device backing file, setting one up if
+// the file is not attached yet.
+func attachLoopDevice(file string) (string, error) {
+	devices, err := findLoopDevices(file)
+	if err != nil {
+		return "", err
+	}
+	if len(devices) > 0 {
+		return devices[0], nil
+	}
+
+	executor := utilexec.New()
+	out, err := executor.Command("losetup", "-f", "--show", file).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to attach loop device for %s: %v: %s", file, err, out)
+	}
+	device := strings.TrimSpace(string(out))
+	glog.V(4).Infof("attached %s to loop device %s", file, device)
+	return device, nil
+}
+
+// detachLoopDevices releases all loop devices backed by file.
+func detachLoopDevices(file string) error {
+	devices, err := findLoopDevices(file)
+	if err != nil {
+		return err
+	}
+
+	executor := utilexec.New()
+	for _, device := range devices {
+		out, err := executor.Command("losetup", "-d", device).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to detach loop device %s: %v: %s", device, err, out)
+		}
+		glog.V(4).Infof("detached loop device %s from %s", device, file)
+	}
+	return nil
+}
+
+// findLoopDevices lists the loop devices backed by file.
+func findLoopDevices(file string) ([]string, error) {
+	executor := utilexec.New()
+	out, err := executor.Command("losetup", "-j", file).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list loop devices for %s: %v: %s", file, err, out)
+	}
+
+	// Each line looks like "/dev/loop0: [2049]:1234 (/path/to/file)"
+	var devices []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			devices = append(devices, line[:i])
+		}
+	}
+	return devices, nil
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeMkfs returns a mkfs.<fsType> script which logs its arguments and
+// exits with the given code.
+func fakeMkfs(fsType, exitCode string) string {
+	return "#!/bin/sh\necho \"mkfs." + fsType + " $*\" >>\"$CALLLOG\"\nexit " + exitCode + "\n"
+}
+
+// toolCalls returns the commands logged by the fake tools.
+func toolCalls(t *testing.T, toolDir string) []string {
+	out, err := ioutil.ReadFile(filepath.Join(toolDir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestCreateImage(t *testing.T) {
+	toolDir, cleanup := fakeTools(t, map[string]string{
+		"mkfs.ext4": fakeMkfs("ext4", "0"),
+		"mkfs.xfs":  fakeMkfs("xfs", "0"),
+		"mkfs.bad":  fakeMkfs("bad", "1"),
+	})
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		fsType string
+		call   string
+		fail   bool
+	}{
+		{
+			name: "unformatted",
+		},
+		{
+			name:   "ext4",
+			fsType: "ext4",
+			call:   "mkfs.ext4 -F -m0 ",
+		},
+		{
+			name:   "xfs",
+			fsType: "xfs",
+			call:   "mkfs.xfs ",
+		},
+		{
+			name:   "mkfs fails",
+			fsType: "bad",
+			call:   "mkfs.bad ",
+			fail:   true,
+		},
+	}
+
+	for _, test := range tests {
+		os.Remove(filepath.Join(toolDir, "calls"))
+		path := filepath.Join(toolDir, test.name+".img")
+		err := createImage(path, 10*mib, test.fsType)
+
+		var expected []string
+		if test.call != "" {
+			expected = []string{test.call + path}
+		}
+		assert.Equal(t, expected, toolCalls(t, toolDir), test.name)
+		if test.fail {
+			assert.Error(t, err, test.name)
+			// The image is removed again
+			_, err = os.Stat(path)
+			assert.True(t, os.IsNotExist(err), test.name)
+			continue
+		}
+		assert.NoError(t, err, test.name)
+		fi, err := os.Stat(path)
+		if assert.NoError(t, err, test.name) {
+			assert.Equal(t, 10*mib, fi.Size(), test.name)
+		}
+	}
+
+	// Existing files are never overwritten
+	path := filepath.Join(toolDir, "ext4.img")
+	assert.Error(t, createImage(path, mib, "ext4"))
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*mib, fi.Size())
+}
+
+func TestAttachLoopDevice(t *testing.T) {
+	toolDir, cleanup := fakeTools(t, map[string]string{"losetup": fakeLosetup})
+	defer cleanup()
+
+	image := filepath.Join(toolDir, "vol.img")
+	device, err := attachLoopDevice(image)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/loop0", device)
+
+	// An attached image keeps its loop device
+	device, err = attachLoopDevice(image)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/loop0", device)
+
+	device, err = attachLoopDevice(filepath.Join(toolDir, "other.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/loop1", device)
+
+	assert.NoError(t, detachLoopDevices(image))
+	assert.Equal(t, []string{"/dev/loop1"}, attachedLoopDevices(t, toolDir))
+}
+
+func TestGetFsType(t *testing.T) {
+	mountCap := func(fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: fsType},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		caps     []*csi.VolumeCapability
+		expected string
+	}{
+		"no capabilities": {
+			expected: defaultFsType,
+		},
+		"no fsType": {
+			caps:     []*csi.VolumeCapability{mountCap("")},
+			expected: defaultFsType,
+		},
+		"fsType": {
+			caps:     []*csi.VolumeCapability{mountCap("xfs")},
+			expected: "xfs",
+		},
+		"first fsType": {
+			caps:     []*csi.VolumeCapability{mountCap(""), mountCap("ext3"), mountCap("xfs")},
+			expected: "ext3",
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.expected, getFsType(test.caps), name)
+	}
+}
+
+func TestCreateVolumeProvisioningMode(t *testing.T) {
+	toolDir, cleanup := fakeTools(t, map[string]string{
+		"mkfs.ext4": fakeMkfs("ext4", "0"),
+		"mkfs.xfs":  fakeMkfs("xfs", "0"),
+		"mkfs.bad":  fakeMkfs("bad", "1"),
+	})
+	defer cleanup()
+	cs, cleanupController := newFakeControllerServer(t)
+	defer cleanupController()
+	// Leave room for volumes of the default image size
+	cs.statfs = func(path string, buf *unix.Statfs_t) error {
+		*buf = unix.Statfs_t{Bsize: mib, Frsize: mib, Blocks: 10000, Bfree: 10000, Bavail: 10000}
+		return nil
+	}
+
+	loopback := func(name, fsType string) *csi.CreateVolumeRequest {
+		req := newCreateVolumeRequest(name)
+		req.CapacityRange = nil
+		req.Parameters = map[string]string{paramProvisioningMode: provisioningModeLoopback}
+		req.VolumeCapabilities[0].GetMount().FsType = fsType
+		return req
+	}
+
+	// Unknown modes are rejected
+	req := newCreateVolumeRequest("unknown")
+	req.Parameters = map[string]string{paramProvisioningMode: "tmpfs"}
+	_, err := cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Loopback volumes cannot be cloned
+	req = loopback("clone", "")
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "source"},
+		},
+	}
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Nil(t, toolCalls(t, toolDir))
+
+	// Loopback volumes default to an ext4 image of defaultImageSize
+	resp, err := cs.CreateVolume(context.Background(), loopback("default", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultImageSize, resp.GetVolume().GetCapacityBytes())
+	vol, err := cs.state.getVolumeByID(resp.GetVolume().GetVolumeId())
+	assert.NoError(t, err)
+	assert.Equal(t, provisioningModeLoopback, vol.VolType)
+	assert.Equal(t, defaultFsType, vol.FsType)
+	assert.Equal(t, []string{"mkfs.ext4 -F -m0 " + vol.VolPath}, toolCalls(t, toolDir))
+	fi, err := os.Stat(vol.VolPath)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultImageSize, fi.Size())
+
+	// The fsType of the mount capability is honored
+	os.Remove(filepath.Join(toolDir, "calls"))
+	resp, err = cs.CreateVolume(context.Background(), loopback("xfs", "xfs"))
+	assert.NoError(t, err)
+	vol, err = cs.state.getVolumeByID(resp.GetVolume().GetVolumeId())
+	assert.NoError(t, err)
+	assert.Equal(t, "xfs", vol.FsType)
+	assert.Equal(t, []string{"mkfs.xfs " + vol.VolPath}, toolCalls(t, toolDir))
+
+	// Block volumes are not formatted
+	os.Remove(filepath.Join(toolDir, "calls"))
+	req = loopback("block", "")
+	req.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Block{
+		Block: &csi.VolumeCapability_BlockVolume{},
+	}
+	resp, err = cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	vol, err = cs.state.getVolumeByID(resp.GetVolume().GetVolumeId())
+	assert.NoError(t, err)
+	assert.Equal(t, volTypeBlock, vol.VolType)
+	assert.Empty(t, vol.FsType)
+	assert.Nil(t, toolCalls(t, toolDir))
+
+	// A failing mkfs leaves neither an image nor a volume behind
+	images, err := filepath.Glob(filepath.Join(cs.dataRoot, "*.img"))
+	assert.NoError(t, err)
+	_, err = cs.CreateVolume(context.Background(), loopback("bad", "bad"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	after, err := filepath.Glob(filepath.Join(cs.dataRoot, "*.img"))
+	assert.NoError(t, err)
+	assert.Equal(t, images, after)
+	_, err = cs.state.getVolumeByName("bad")
+	assert.Error(t, err)
+}
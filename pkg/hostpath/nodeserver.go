@@ -18,6 +18,7 @@ package hostpath
 
 import (
 	"os"
+	"path/filepath"
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -32,6 +33,9 @@ import (
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	state    *state
+	dataRoot string
+	mounter  mount.Interface
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
@@ -47,8 +51,30 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	vol, err := ns.state.getVolumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	if req.GetVolumeCapability().GetBlock() != nil {
+		if vol.VolType != volTypeBlock {
+			return nil, status.Error(codes.InvalidArgument, "Cannot publish a non-block volume as block volume")
+		}
+		if err := publishBlockVolume(ns.mounter, vol, targetPath, req.GetReadonly()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// The loop device is shared by all targets of the volume
+		if err := ns.state.addPublishedTarget(vol.VolID, targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if vol.VolType == volTypeBlock {
+		return nil, status.Error(codes.InvalidArgument, "Cannot publish a block volume as mount volume")
+	}
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err = os.MkdirAll(targetPath, 0750); err != nil {
@@ -79,13 +105,22 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	glog.V(4).Infof("target %v\nfstype %v\ndevice %v\nreadonly %v\nvolumeId %v\nattributes %v\nmountflags %v\n",
 		targetPath, fsType, deviceId, readOnly, volumeId, attrib, mountFlags)
 
-	options := []string{"bind"}
+	var options []string
+	path := filepath.Join(ns.dataRoot, volumeId)
+	switch vol.VolType {
+	case provisioningModeLoopback:
+		// mount(8) sets up the loop device and releases it again on unmount
+		options = []string{"loop"}
+		fsType = vol.FsType
+		path = vol.VolPath
+	default:
+		options = []string{"bind"}
+		fsType = ""
+	}
 	if readOnly {
 		options = append(options, "ro")
 	}
-	mounter := mount.New("")
-	path := provisionRoot + volumeId
-	if err := mounter.Mount(path, targetPath, "", options); err != nil {
+	if err := ns.mounter.Mount(path, targetPath, fsType, options); err != nil {
 		return nil, err
 	}
 
@@ -105,15 +140,68 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	volumeID := req.GetVolumeId()
 
 	// Unmounting the image
-	err := mount.New("").Unmount(req.GetTargetPath())
+	err := ns.mounter.Unmount(req.GetTargetPath())
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	glog.V(4).Infof("hostpath: volume %s/%s has been unmounted.", targetPath, volumeID)
 
+	if vol, err := ns.state.getVolumeByID(volumeID); err == nil && vol.VolType == volTypeBlock {
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		remaining, err := ns.state.removePublishedTarget(volumeID, targetPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		// Other targets still use the loop device
+		if remaining > 0 {
+			glog.V(4).Infof("hostpath: block volume %s is still published at %d targets", volumeID, remaining)
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
+		if err := detachLoopDevices(vol.VolPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// publishBlockVolume attaches the image of a block volume to a loop device
+// and bind-mounts the device node onto targetPath, which must be a file.
+func publishBlockVolume(mounter mount.Interface, vol hostPathVolume, targetPath string, readOnly bool) error {
+	device, err := attachLoopDevice(vol.VolPath)
+	if err != nil {
+		return err
+	}
+
+	notMnt, err := mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(targetPath, os.O_CREATE, 0660)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		notMnt = true
+	}
+	if !notMnt {
+		return nil
+	}
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	glog.V(4).Infof("hostpath: publishing block volume %s via %s at %s", vol.VolID, device, targetPath)
+	return mounter.Mount(device, targetPath, "", options)
+}
+
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 
 	// Check arguments
@@ -139,3 +227,16 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if _, err := ns.state.getVolumeByID(req.GetVolumeId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return csicommon.GetVolumeStats(req.GetVolumePath())
+}
@@ -0,0 +1,343 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+// fakeLosetup emulates losetup(8). Each attached loop device is a file in
+// $LOOPDIR holding the path of its backing file.
+const fakeLosetup = `#!/bin/sh
+echo "losetup $*" >>"$CALLLOG"
+case "$1" in
+-j)
+	for dev in "$LOOPDIR"/loop*; do
+		[ -f "$dev" ] || continue
+		if [ "$(cat "$dev")" = "$2" ]; then
+			echo "/dev/$(basename "$dev"): [2049]:1234 ($2)"
+		fi
+	done
+	;;
+-f)
+	n=0
+	while [ -f "$LOOPDIR/loop$n" ]; do n=$((n+1)); done
+	echo "$3" >"$LOOPDIR/loop$n"
+	echo "/dev/loop$n"
+	;;
+-d)
+	rm "$LOOPDIR/$(basename "$2")" || exit 1
+	;;
+*)
+	echo "unsupported arguments: $*" >&2
+	exit 1
+	;;
+esac
+`
+
+// fakeTools installs the given scripts in a temporary directory in front of
+// PATH. It returns the directory, which also holds the call log and the
+// loop device state, and a function restoring the environment.
+func fakeTools(t *testing.T, tools map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "hostpath-tools")
+	assert.NoError(t, err)
+	binDir := filepath.Join(dir, "bin")
+	loopDir := filepath.Join(dir, "loop")
+	assert.NoError(t, os.Mkdir(binDir, 0750))
+	assert.NoError(t, os.Mkdir(loopDir, 0750))
+	for name, script := range tools {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(binDir, name), []byte(script), 0750))
+	}
+
+	env := map[string]string{
+		"PATH":    binDir + string(os.PathListSeparator) + os.Getenv("PATH"),
+		"CALLLOG": filepath.Join(dir, "calls"),
+		"LOOPDIR": loopDir,
+	}
+	saved := map[string]string{}
+	for k, v := range env {
+		saved[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return dir, func() {
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// attachedLoopDevices lists the loop devices set up by the fake losetup.
+func attachedLoopDevices(t *testing.T, toolDir string) []string {
+	files, err := ioutil.ReadDir(filepath.Join(toolDir, "loop"))
+	assert.NoError(t, err)
+	var devices []string
+	for _, f := range files {
+		devices = append(devices, "/dev/"+f.Name())
+	}
+	return devices
+}
+
+// optionsMounter records the options of every mount, which FakeMounter
+// drops except for "ro".
+type optionsMounter struct {
+	*mount.FakeMounter
+	options [][]string
+}
+
+func (m *optionsMounter) Mount(source string, target string, fstype string, options []string) error {
+	m.options = append(m.options, options)
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+func newFakeNodeServer(t *testing.T) (*nodeServer, *mount.FakeMounter, func()) {
+	dir, err := ioutil.TempDir("", "hostpath-node")
+	assert.NoError(t, err)
+
+	d := csicommon.NewCSIDriver("fake", "1.0.0", "fakeNodeID")
+	st, err := loadState(dir)
+	assert.NoError(t, err)
+
+	mounter := &mount.FakeMounter{}
+	ns := NewNodeServer(d, st, dir)
+	ns.mounter = mounter
+	return ns, mounter, func() { os.RemoveAll(dir) }
+}
+
+// addFakeVolume registers a volume of the given type backed by an empty
+// file.
+func addFakeVolume(t *testing.T, ns *nodeServer, id, volType string) hostPathVolume {
+	vol := hostPathVolume{
+		VolName: id,
+		VolID:   id,
+		VolPath: filepath.Join(ns.dataRoot, id+".img"),
+		VolType: volType,
+	}
+	assert.NoError(t, ioutil.WriteFile(vol.VolPath, nil, 0600))
+	assert.NoError(t, ns.state.addVolume(vol))
+	return vol
+}
+
+func newNodePublishVolumeRequest(volumeID, targetPath string, block bool) *csi.NodePublishVolumeRequest {
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	if block {
+		capability.AccessType = &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		}
+	}
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:         volumeID,
+		TargetPath:       targetPath,
+		VolumeCapability: capability,
+	}
+}
+
+func TestFindLoopDevices(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected []string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "one",
+			output:   "/dev/loop0: [2049]:1234 (/data/vol.img)",
+			expected: []string{"/dev/loop0"},
+		},
+		{
+			name:     "several",
+			output:   "/dev/loop0: [2049]:1234 (/data/vol.img)\n/dev/loop3: [2049]:1234 (/data/vol.img)\n",
+			expected: []string{"/dev/loop0", "/dev/loop3"},
+		},
+		{
+			name:     "path with colon",
+			output:   "/dev/loop1: [2049]:1234 (/data/a:b.img)\n",
+			expected: []string{"/dev/loop1"},
+		},
+	}
+
+	for _, test := range tests {
+		script := "#!/bin/sh\ncat <<'EOF'\n" + test.output + "\nEOF\n"
+		_, cleanup := fakeTools(t, map[string]string{"losetup": script})
+		devices, err := findLoopDevices("/data/vol.img")
+		cleanup()
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, devices, test.name)
+	}
+
+	_, cleanup := fakeTools(t, map[string]string{"losetup": "#!/bin/sh\necho failed >&2\nexit 1\n"})
+	defer cleanup()
+	_, err := findLoopDevices("/data/vol.img")
+	assert.Error(t, err)
+}
+
+func TestPublishBlockVolume(t *testing.T) {
+	toolDir, cleanup := fakeTools(t, map[string]string{"losetup": fakeLosetup})
+	defer cleanup()
+	ns, mounter, cleanupNode := newFakeNodeServer(t)
+	defer cleanupNode()
+
+	vol := addFakeVolume(t, ns, "vol", volTypeBlock)
+	targetPath := filepath.Join(ns.dataRoot, "pods", "target")
+	assert.NoError(t, publishBlockVolume(mounter, vol, targetPath, true))
+
+	// The target is a file onto which the loop device is bind-mounted.
+	fi, err := os.Stat(targetPath)
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, []string{"/dev/loop0"}, attachedLoopDevices(t, toolDir))
+	if assert.Len(t, mounter.MountPoints, 1) {
+		mp := mounter.MountPoints[0]
+		assert.Equal(t, "/dev/loop0", mp.Device)
+		assert.Equal(t, targetPath, mp.Path)
+		// FakeMounter records bind mounts without the "bind" option.
+		assert.Equal(t, []string{"ro"}, mp.Opts)
+	}
+
+	// Publishing again reuses the attached loop device.
+	assert.NoError(t, publishBlockVolume(mounter, vol, targetPath, true))
+	assert.Equal(t, []string{"/dev/loop0"}, attachedLoopDevices(t, toolDir))
+	assert.Len(t, mounter.MountPoints, 1)
+}
+
+func TestNodePublishVolumeAccessTypeMismatch(t *testing.T) {
+	ns, _, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	addFakeVolume(t, ns, "block", volTypeBlock)
+	addFakeVolume(t, ns, "mount", provisioningModeDirectory)
+	targetPath := filepath.Join(ns.dataRoot, "target")
+
+	_, err := ns.NodePublishVolume(context.Background(), newNodePublishVolumeRequest("mount", targetPath, true))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = ns.NodePublishVolume(context.Background(), newNodePublishVolumeRequest("block", targetPath, false))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeUnpublishBlockVolumeSharedLoopDevice(t *testing.T) {
+	toolDir, cleanup := fakeTools(t, map[string]string{"losetup": fakeLosetup})
+	defer cleanup()
+	ns, _, cleanupNode := newFakeNodeServer(t)
+	defer cleanupNode()
+
+	addFakeVolume(t, ns, "vol", volTypeBlock)
+	target1 := filepath.Join(ns.dataRoot, "pod1", "target")
+	target2 := filepath.Join(ns.dataRoot, "pod2", "target")
+	for _, target := range []string{target1, target2} {
+		_, err := ns.NodePublishVolume(context.Background(), newNodePublishVolumeRequest("vol", target, true))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"/dev/loop0"}, attachedLoopDevices(t, toolDir))
+
+	// The second target still uses the loop device.
+	_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: target1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/dev/loop0"}, attachedLoopDevices(t, toolDir))
+
+	// The published targets survive a restart.
+	st, err := loadState(ns.dataRoot)
+	assert.NoError(t, err)
+	ns.state = st
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: target2})
+	assert.NoError(t, err)
+	assert.Empty(t, attachedLoopDevices(t, toolDir))
+
+	calls, err := ioutil.ReadFile(filepath.Join(toolDir, "calls"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(calls), "losetup -d"))
+}
+
+func TestNodePublishLoopbackVolume(t *testing.T) {
+	ns, fake, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+	mounter := &optionsMounter{FakeMounter: fake}
+	ns.mounter = mounter
+
+	vol := addFakeVolume(t, ns, "vol", provisioningModeLoopback)
+	vol.FsType = "xfs"
+	assert.NoError(t, ns.state.addVolume(vol))
+	targetPath := filepath.Join(ns.dataRoot, "target")
+
+	// mount(8) attaches the image itself, with the fsType it was
+	// formatted with.
+	req := newNodePublishVolumeRequest("vol", targetPath, false)
+	req.Readonly = true
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.Len(t, mounter.MountPoints, 1) {
+		mp := mounter.MountPoints[0]
+		assert.Equal(t, vol.VolPath, mp.Device)
+		assert.Equal(t, targetPath, mp.Path)
+		assert.Equal(t, "xfs", mp.Type)
+	}
+	assert.Equal(t, [][]string{{"loop", "ro"}}, mounter.options)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.MountPoints)
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, _, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+	addFakeVolume(t, ns, "vol", provisioningModeDirectory)
+
+	// Unknown volume
+	_, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "unknown", VolumePath: ns.dataRoot})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The volume is not published at the path
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol", VolumePath: ns.dataRoot})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol", VolumePath: filepath.Join(ns.dataRoot, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	ns := NewNodeServer(newCSIDriver("fake", "fakeNodeID"), newState(""), "")
+
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	var types []csi.NodeServiceCapability_RPC_Type
+	for _, cap := range resp.GetCapabilities() {
+		types = append(types, cap.GetRpc().GetType())
+	}
+	assert.Contains(t, types, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
+}
@@ -0,0 +1,451 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	stateFileName = "csi-hostpath-state.json"
+)
+
+// state holds the volumes and snapshots known to the driver and persists them
+// to a file. It is safe for concurrent use by the gRPC handlers and the
+// background snapshot jobs.
+type state struct {
+	sync.Mutex
+
+	// file is the path the state is persisted to. An empty path disables
+	// persistence.
+	file string
+
+	volumes   map[string]hostPathVolume
+	snapshots map[string]hostPathSnapshot
+
+	// pendingVolumes maps the names of volumes which are being created to
+	// the capacity reserved for them.
+	pendingVolumes map[string]int64
+	// pendingSnapshots holds the names of snapshots which are being created.
+	pendingSnapshots map[string]bool
+	// snapshotJobs holds the progress of the snapshots whose archive is
+	// being written, by ID.
+	snapshotJobs map[string]*snapshotProgress
+}
+
+// snapshotProgress tracks the archive of a snapshot being written.
+type snapshotProgress struct {
+	// archived is the number of bytes of the volume archived so far. It is
+	// updated atomically by the snapshot job.
+	archived int64
+	// total is the estimated number of bytes to archive.
+	total int64
+}
+
+// percent returns the share of the volume archived so far. It stays below
+// 100 until the archive is complete, since total is only an estimate.
+func (p *snapshotProgress) percent() int64 {
+	if p.total <= 0 {
+		return 0
+	}
+	percent := atomic.LoadInt64(&p.archived) * 100 / p.total
+	if percent > 99 {
+		percent = 99
+	}
+	return percent
+}
+
+func (p *snapshotProgress) Write(data []byte) (int, error) {
+	atomic.AddInt64(&p.archived, int64(len(data)))
+	return len(data), nil
+}
+
+// persistentState is the on-disk representation of the driver state.
+type persistentState struct {
+	Volumes   map[string]hostPathVolume   `json:"volumes"`
+	Snapshots map[string]hostPathSnapshot `json:"snapshots"`
+}
+
+func newState(file string) *state {
+	return &state{
+		file:             file,
+		volumes:          map[string]hostPathVolume{},
+		snapshots:        map[string]hostPathSnapshot{},
+		pendingVolumes:   map[string]int64{},
+		pendingSnapshots: map[string]bool{},
+		snapshotJobs:     map[string]*snapshotProgress{},
+	}
+}
+
+// loadState reads the state file in stateDir. Entries whose data no longer
+// exists on disk are dropped, and the reconciled state is written back.
+func loadState(stateDir string) (*state, error) {
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %v", stateDir, err)
+	}
+	s := newState(filepath.Join(stateDir, stateFileName))
+
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			glog.V(4).Infof("no state found at %s, starting empty", s.file)
+			return s, s.save()
+		}
+		return nil, fmt.Errorf("failed to read state file %s: %v", s.file, err)
+	}
+
+	ps := persistentState{}
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, fmt.Errorf("failed to decode state file %s: %v", s.file, err)
+	}
+
+	for id, vol := range ps.Volumes {
+		if _, err := os.Stat(vol.VolPath); err != nil {
+			glog.Warningf("dropping volume %s (%s): %v", id, vol.VolName, err)
+			continue
+		}
+		s.volumes[id] = vol
+	}
+	for id, snap := range ps.Snapshots {
+		if _, err := os.Stat(snap.Path); err != nil && snap.ReadyToUse {
+			glog.Warningf("dropping snapshot %s (%s): %v", id, snap.Name, err)
+			continue
+		}
+		s.snapshots[id] = snap
+	}
+	glog.V(4).Infof("loaded %d volumes and %d snapshots from %s", len(s.volumes), len(s.snapshots), s.file)
+
+	return s, s.save()
+}
+
+// save writes the volumes and snapshots to the state file. The file is
+// replaced atomically so a crash never leaves a partial state behind. The
+// caller must hold the lock.
+func (s *state) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(&persistentState{
+		Volumes:   s.volumes,
+		Snapshots: s.snapshots,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return fmt.Errorf("failed to replace state file %s: %v", s.file, err)
+	}
+	return nil
+}
+
+// beginCreateVolume marks the volume name as being created. Every successful
+// call must be paired with endCreateVolume.
+func (s *state) beginCreateVolume(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.pendingVolumes[name]; ok {
+		return status.Errorf(codes.Aborted, "Volume %s is already being created", name)
+	}
+	s.pendingVolumes[name] = 0
+	return nil
+}
+
+// reserveCapacity reserves size bytes for the volume name which is being
+// created, provided that all volumes and reservations fit into limit.
+func (s *state) reserveCapacity(name string, size, limit int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if available := limit - s.allocated(); size > available {
+		return status.Errorf(codes.ResourceExhausted, "Requested capacity %d exceeds available capacity %d", size, available)
+	}
+	s.pendingVolumes[name] = size
+	return nil
+}
+
+// endCreateVolume clears the mark set by beginCreateVolume and releases any
+// capacity reserved for the volume.
+func (s *state) endCreateVolume(name string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pendingVolumes, name)
+}
+
+// beginCreateSnapshot marks the snapshot name as being created. Every
+// successful call must be paired with endCreateSnapshot.
+func (s *state) beginCreateSnapshot(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pendingSnapshots[name] {
+		return status.Errorf(codes.Aborted, "Snapshot %s is already being created", name)
+	}
+	s.pendingSnapshots[name] = true
+	return nil
+}
+
+// endCreateSnapshot clears the mark set by beginCreateSnapshot.
+func (s *state) endCreateSnapshot(name string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pendingSnapshots, name)
+}
+
+// allocatedCapacity returns the capacity of all volumes plus the capacity
+// reserved for volumes which are being created.
+func (s *state) allocatedCapacity() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.allocated()
+}
+
+func (s *state) allocated() int64 {
+	var allocated int64
+	for _, vol := range s.volumes {
+		allocated += vol.VolSize
+	}
+	for _, size := range s.pendingVolumes {
+		allocated += size
+	}
+	return allocated
+}
+
+func (s *state) getVolumeByID(volumeID string) (hostPathVolume, error) {
+	s.Lock()
+	defer s.Unlock()
+	if hostPathVol, ok := s.volumes[volumeID]; ok {
+		return hostPathVol, nil
+	}
+	return hostPathVolume{}, fmt.Errorf("volume id %s does not exit in the volumes list", volumeID)
+}
+
+func (s *state) getVolumeByName(volName string) (hostPathVolume, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, hostPathVol := range s.volumes {
+		if hostPathVol.VolName == volName {
+			return hostPathVol, nil
+		}
+	}
+	return hostPathVolume{}, fmt.Errorf("volume name %s does not exit in the volumes list", volName)
+}
+
+// listVolumes returns all volumes sorted by ID.
+func (s *state) listVolumes() []hostPathVolume {
+	s.Lock()
+	defer s.Unlock()
+	volumes := make([]hostPathVolume, 0, len(s.volumes))
+	for _, vol := range s.volumes {
+		volumes = append(volumes, vol)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].VolID < volumes[j].VolID })
+	return volumes
+}
+
+func (s *state) addVolume(vol hostPathVolume) error {
+	s.Lock()
+	defer s.Unlock()
+	s.volumes[vol.VolID] = vol
+	if err := s.save(); err != nil {
+		delete(s.volumes, vol.VolID)
+		return err
+	}
+	return nil
+}
+
+// deleteVolume removes the volume volumeID. Volumes are not deleted while
+// the archive of a snapshot of theirs is being written.
+func (s *state) deleteVolume(volumeID string) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, snapshot := range s.snapshots {
+		if snapshot.VolID == volumeID && !snapshot.ReadyToUse {
+			return status.Errorf(codes.FailedPrecondition, "Volume %s is in use by snapshot %s which is not ready yet", volumeID, snapshot.Id)
+		}
+	}
+	delete(s.volumes, volumeID)
+	return s.save()
+}
+
+// addPublishedTarget records that the volume volumeID is published at
+// target.
+func (s *state) addPublishedTarget(volumeID, target string) error {
+	s.Lock()
+	defer s.Unlock()
+	vol, ok := s.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume id %s does not exit in the volumes list", volumeID)
+	}
+	for _, t := range vol.PublishedTargets {
+		if t == target {
+			return nil
+		}
+	}
+	prev := vol
+	vol.PublishedTargets = append(append([]string{}, vol.PublishedTargets...), target)
+	s.volumes[volumeID] = vol
+	if err := s.save(); err != nil {
+		s.volumes[volumeID] = prev
+		return err
+	}
+	return nil
+}
+
+// removePublishedTarget forgets that the volume volumeID is published at
+// target and returns the number of targets it is still published at.
+func (s *state) removePublishedTarget(volumeID, target string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	vol, ok := s.volumes[volumeID]
+	if !ok {
+		return 0, nil
+	}
+	var targets []string
+	for _, t := range vol.PublishedTargets {
+		if t != target {
+			targets = append(targets, t)
+		}
+	}
+	if len(targets) == len(vol.PublishedTargets) {
+		return len(targets), nil
+	}
+	prev := vol
+	vol.PublishedTargets = targets
+	s.volumes[volumeID] = vol
+	if err := s.save(); err != nil {
+		s.volumes[volumeID] = prev
+		return 0, err
+	}
+	return len(targets), nil
+}
+
+func (s *state) getSnapshotByID(snapshotID string) (hostPathSnapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+	if snapshot, ok := s.snapshots[snapshotID]; ok {
+		return snapshot, nil
+	}
+	return hostPathSnapshot{}, fmt.Errorf("snapshot id %s does not exit in the snapshots list", snapshotID)
+}
+
+func (s *state) getSnapshotByName(name string) (hostPathSnapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, snapshot := range s.snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
+		}
+	}
+	return hostPathSnapshot{}, fmt.Errorf("snapshot name %s does not exit in the snapshots list", name)
+}
+
+// listSnapshots returns all snapshots sorted by ID.
+func (s *state) listSnapshots() []hostPathSnapshot {
+	s.Lock()
+	defer s.Unlock()
+	snapshots := make([]hostPathSnapshot, 0, len(s.snapshots))
+	for _, snap := range s.snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Id < snapshots[j].Id })
+	return snapshots
+}
+
+// addSnapshot adds snapshot, provided that its source volume still exists.
+func (s *state) addSnapshot(snapshot hostPathSnapshot) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.volumes[snapshot.VolID]; !ok {
+		return status.Errorf(codes.NotFound, "Volume %s does not exist", snapshot.VolID)
+	}
+	s.snapshots[snapshot.Id] = snapshot
+	if err := s.save(); err != nil {
+		delete(s.snapshots, snapshot.Id)
+		return err
+	}
+	return nil
+}
+
+func (s *state) deleteSnapshot(snapshotID string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.snapshots, snapshotID)
+	delete(s.snapshotJobs, snapshotID)
+	return s.save()
+}
+
+// startSnapshotJob returns the progress of a job archiving total bytes for
+// the snapshot snapshotID.
+func (s *state) startSnapshotJob(snapshotID string, total int64) *snapshotProgress {
+	s.Lock()
+	defer s.Unlock()
+	progress := &snapshotProgress{total: total}
+	s.snapshotJobs[snapshotID] = progress
+	return progress
+}
+
+// getSnapshotProgress returns the progress of the snapshot snapshotID if its
+// archive is being written.
+func (s *state) getSnapshotProgress(snapshotID string) (*snapshotProgress, bool) {
+	s.Lock()
+	defer s.Unlock()
+	progress, ok := s.snapshotJobs[snapshotID]
+	return progress, ok
+}
+
+// completeSnapshot records the outcome of a background snapshot job. A
+// successful snapshot becomes ready to use, a failed one is dropped together
+// with its archive. It returns false if the snapshot was deleted while the
+// job was running, in which case the caller has to remove the archive.
+func (s *state) completeSnapshot(snapshotID string, succeeded bool) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.snapshotJobs, snapshotID)
+	snapshot, ok := s.snapshots[snapshotID]
+	if !ok {
+		return false, nil
+	}
+	if succeeded {
+		snapshot.ReadyToUse = true
+		s.snapshots[snapshotID] = snapshot
+	} else {
+		os.RemoveAll(snapshot.Path)
+		delete(s.snapshots, snapshotID)
+	}
+	return true, s.save()
+}
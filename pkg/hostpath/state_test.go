@@ -0,0 +1,184 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	volPath := filepath.Join(dir, "vol")
+	assert.NoError(t, os.Mkdir(volPath, 0750))
+
+	s, err := loadState(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, s.addVolume(hostPathVolume{VolName: "exists", VolID: "1", VolPath: volPath}))
+	assert.NoError(t, s.addVolume(hostPathVolume{VolName: "missing", VolID: "2", VolPath: filepath.Join(dir, "gone")}))
+
+	// Volumes whose data disappeared are dropped on reload.
+	s, err = loadState(dir)
+	assert.NoError(t, err)
+	vol, err := s.getVolumeByName("exists")
+	assert.NoError(t, err)
+	assert.Equal(t, volPath, vol.VolPath)
+	_, err = s.getVolumeByID("2")
+	assert.Error(t, err)
+}
+
+func TestStateSaveLoadRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	volPath := filepath.Join(dir, "vol.img")
+	snapPath := filepath.Join(dir, "snap.tgz")
+	assert.NoError(t, ioutil.WriteFile(volPath, nil, 0600))
+	assert.NoError(t, ioutil.WriteFile(snapPath, nil, 0600))
+	vol := hostPathVolume{
+		VolName:          "vol",
+		VolID:            "1",
+		VolSize:          mib,
+		VolPath:          volPath,
+		VolType:          volTypeBlock,
+		FsType:           "xfs",
+		PublishedTargets: []string{"/target/1", "/target/2"},
+	}
+	snap := hostPathSnapshot{
+		Name:         "snap",
+		Id:           "2",
+		VolID:        "1",
+		Path:         snapPath,
+		CreationTime: timestamp.Timestamp{Seconds: 1550000000, Nanos: 42},
+		SizeBytes:    mib,
+		ReadyToUse:   true,
+	}
+
+	s, err := loadState(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, s.addVolume(vol))
+	assert.NoError(t, s.addSnapshot(snap))
+
+	s, err = loadState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []hostPathVolume{vol}, s.listVolumes())
+	assert.Equal(t, []hostPathSnapshot{snap}, s.listSnapshots())
+
+	// Loading writes the state back unchanged
+	s, err = loadState(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []hostPathVolume{vol}, s.listVolumes())
+	assert.Equal(t, []hostPathSnapshot{snap}, s.listSnapshots())
+}
+
+func TestStateBeginCreateVolume(t *testing.T) {
+	s := newState("")
+
+	assert.NoError(t, s.beginCreateVolume("vol"))
+	err := s.beginCreateVolume("vol")
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// Reservations count against the limit until they are released.
+	assert.NoError(t, s.reserveCapacity("vol", 60, 100))
+	assert.NoError(t, s.beginCreateVolume("other"))
+	err = s.reserveCapacity("other", 60, 100)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	s.endCreateVolume("vol")
+	assert.NoError(t, s.reserveCapacity("other", 60, 100))
+	s.endCreateVolume("other")
+	assert.Zero(t, s.allocatedCapacity())
+}
+
+func TestStateConcurrentAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := loadState(dir)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("%d", i)
+			assert.NoError(t, s.addVolume(hostPathVolume{VolName: "vol-" + id, VolID: id, VolPath: dir, VolSize: 1}))
+			assert.NoError(t, s.addSnapshot(hostPathSnapshot{Name: "snap-" + id, Id: id, VolID: id}))
+			s.listVolumes()
+			s.listSnapshots()
+			s.allocatedCapacity()
+			s.getVolumeByName("vol-" + id)
+			s.getSnapshotByName("snap-" + id)
+			_, err := s.completeSnapshot(id, true)
+			assert.NoError(t, err)
+			if i%2 == 0 {
+				assert.NoError(t, s.deleteSnapshot(id))
+				assert.NoError(t, s.deleteVolume(id))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Len(t, s.listVolumes(), 25)
+	assert.Len(t, s.listSnapshots(), 25)
+	for _, snap := range s.listSnapshots() {
+		assert.True(t, snap.ReadyToUse)
+	}
+}
+
+func TestStateSnapshotProgress(t *testing.T) {
+	s := newState("")
+	assert.NoError(t, s.addVolume(hostPathVolume{VolID: "vol"}))
+	assert.NoError(t, s.addSnapshot(hostPathSnapshot{Id: "snap", VolID: "vol"}))
+	_, ok := s.getSnapshotProgress("snap")
+	assert.False(t, ok)
+
+	progress := s.startSnapshotJob("snap", 200)
+	progress.Write(make([]byte, 50))
+	p, ok := s.getSnapshotProgress("snap")
+	assert.True(t, ok)
+	assert.Equal(t, int64(25), p.percent())
+	// The estimate may be exceeded, but the archive is not done until the
+	// job completes
+	progress.Write(make([]byte, 200))
+	assert.Equal(t, int64(99), p.percent())
+
+	found, err := s.completeSnapshot("snap", true)
+	assert.True(t, found)
+	assert.NoError(t, err)
+	_, ok = s.getSnapshotProgress("snap")
+	assert.False(t, ok)
+
+	// Snapshots of deleted volumes are refused
+	err = s.addSnapshot(hostPathSnapshot{Id: "other", VolID: "gone"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
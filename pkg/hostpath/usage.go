@@ -0,0 +1,117 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// usageCacheTTL is how long the disk usage of a volume is reused before its
+// files are walked again.
+const usageCacheTTL = time.Minute
+
+type volumeUsage struct {
+	used    int64
+	expires time.Time
+}
+
+// usageCache remembers the disk usage of volumes so that capacity requests
+// do not walk every file of every volume. Usage that grew since it was
+// cached only makes the capacity look smaller, never larger.
+type usageCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	volumes map[string]volumeUsage
+}
+
+func newUsageCache(ttl time.Duration) *usageCache {
+	return &usageCache{
+		ttl:     ttl,
+		volumes: map[string]volumeUsage{},
+	}
+}
+
+// total returns the disk usage of vols, walking only the volumes whose usage
+// expired. Volumes no longer listed are forgotten.
+func (c *usageCache) total(vols []hostPathVolume) (int64, error) {
+	c.mutex.Lock()
+	cached := make(map[string]volumeUsage, len(vols))
+	listed := make(map[string]volumeUsage, len(vols))
+	for _, vol := range vols {
+		if u, ok := c.volumes[vol.VolID]; ok {
+			cached[vol.VolID] = u
+			listed[vol.VolID] = u
+		}
+	}
+	c.volumes = listed
+	c.mutex.Unlock()
+
+	var total int64
+	now := time.Now()
+	for _, vol := range vols {
+		if u, ok := cached[vol.VolID]; ok && now.Before(u.expires) {
+			total += u.used
+			continue
+		}
+		// Walk without holding the lock, concurrent requests may walk
+		// the same volume
+		used, err := diskUsage(vol.VolPath)
+		if err != nil {
+			return 0, err
+		}
+		c.mutex.Lock()
+		c.volumes[vol.VolID] = volumeUsage{used: used, expires: now.Add(c.ttl)}
+		c.mutex.Unlock()
+		total += used
+	}
+	return total, nil
+}
+
+// forget drops the cached usage of volumeID.
+func (c *usageCache) forget(volumeID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.volumes, volumeID)
+}
+
+// diskUsage returns the space allocated to the files below path. Sparse
+// images only count with the blocks actually written.
+func diskUsage(path string) (int64, error) {
+	var used int64
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The volume may be deleted concurrently
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			used += st.Blocks * 512
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to determine disk usage of %s: %v", path, err)
+	}
+	return used, nil
+}
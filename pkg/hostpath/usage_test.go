@@ -0,0 +1,62 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hostpath
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostpath-usage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vol := hostPathVolume{VolID: "vol", VolPath: filepath.Join(dir, "vol")}
+	assert.NoError(t, os.Mkdir(vol.VolPath, 0750))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(vol.VolPath, "data"), make([]byte, mib), 0600))
+	used, err := diskUsage(vol.VolPath)
+	assert.NoError(t, err)
+	assert.True(t, used >= mib)
+
+	c := newUsageCache(time.Hour)
+	total, err := c.total([]hostPathVolume{vol})
+	assert.NoError(t, err)
+	assert.Equal(t, used, total)
+
+	// Writes do not show up until the usage expires
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(vol.VolPath, "more"), make([]byte, mib), 0600))
+	total, err = c.total([]hostPathVolume{vol})
+	assert.NoError(t, err)
+	assert.Equal(t, used, total)
+
+	c.forget(vol.VolID)
+	total, err = c.total([]hostPathVolume{vol})
+	assert.NoError(t, err)
+	assert.True(t, total >= used+mib)
+
+	// Volumes which are gone are dropped from the cache
+	total, err = c.total(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), total)
+	assert.Empty(t, c.volumes)
+}
@@ -19,6 +19,8 @@ package iscsi
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -26,6 +28,10 @@ import (
 type driver struct {
 	csiDriver *csicommon.CSIDriver
 	endpoint  string
+	// stateDir holds the attach config of the volumes staged on this node.
+	stateDir string
+	// legacySecrets allows CHAP credentials in the volume context.
+	legacySecrets bool
 
 	ids *csicommon.DefaultIdentityServer
 	ns  *nodeServer
@@ -42,15 +48,21 @@ var (
 	version = "1.0.0-rc2"
 )
 
-func NewDriver(nodeID, endpoint string) *driver {
+func NewDriver(nodeID, endpoint, stateDir string, legacySecrets bool) *driver {
 	glog.Infof("Driver: %v version: %v", driverName, version)
 
 	d := &driver{}
 
 	d.endpoint = endpoint
+	d.stateDir = stateDir
+	d.legacySecrets = legacySecrets
 
 	csiDriver := csicommon.NewCSIDriver(driverName, version, nodeID)
 	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	csiDriver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	})
 
 	d.csiDriver = csiDriver
 
@@ -60,9 +72,19 @@ func NewDriver(nodeID, endpoint string) *driver {
 func NewNodeServer(d *driver) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		mounter:           mount.New(""),
+		iscsiutil:         &ISCSIUtil{stateDir: d.stateDir},
+		exec:              mount.NewOsExec(),
+		iscsiadm:          newISCSIAdmin(),
+		fs:                &osFilesystem{},
+		deviceUtil:        util.NewDeviceHandler(util.NewIOHandler()),
+		legacySecrets:     d.legacySecrets,
 	}
 }
 
 func (d *driver) Run() {
-	csicommon.RunNodePublishServer(d.endpoint, d.csiDriver, NewNodeServer(d))
+	ns := NewNodeServer(d)
+	// Clean up after volumes which were unstaged while the driver was down
+	ns.iscsiutil.reconcile(ns.mounter, ns.iscsiadm)
+	csicommon.RunNodePublishServer(d.endpoint, d.csiDriver, ns)
 }
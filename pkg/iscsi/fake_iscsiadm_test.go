@@ -0,0 +1,293 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakePortal is a target portal served by fakeISCSIAdmin.
+type fakePortal struct {
+	// targets lists the IQNs the portal exports, each with LUN 0.
+	targets []string
+	// down makes the portal unreachable.
+	down bool
+	// chapUser and chapPassword are required to log in if set.
+	chapUser     string
+	chapPassword string
+	// deviceDelay is the number of lookups of a device node after login
+	// before it appears.
+	deviceDelay int
+}
+
+// fakeISCSIAdmin simulates an open-iscsi initiator. It understands the
+// iscsiadm invocations of the driver, keeps discovery and node records and
+// sessions in memory, and makes device nodes appear in its filesystem on
+// login.
+type fakeISCSIAdmin struct {
+	sync.Mutex
+
+	portals map[string]*fakePortal
+	fs      *fakeFilesystem
+
+	// discovery holds the discoverydb records by portal.
+	discovery map[string]bool
+	// nodes holds the settings of the node records by "portal,iqn".
+	nodes map[string]map[string]string
+	// sessions holds the logged in "portal,iqn" pairs.
+	sessions map[string]bool
+	// ifaces holds the ifaces created besides "default".
+	ifaces map[string]bool
+}
+
+func newFakeISCSIAdmin(portals map[string]*fakePortal) *fakeISCSIAdmin {
+	return &fakeISCSIAdmin{
+		portals:   portals,
+		fs:        newFakeFilesystem(),
+		discovery: map[string]bool{},
+		nodes:     map[string]map[string]string{},
+		sessions:  map[string]bool{},
+		ifaces:    map[string]bool{},
+	}
+}
+
+// fakeDevicePath returns the device node of LUN 0 of iqn at portal.
+func fakeDevicePath(portal, iqn string) string {
+	return strings.Join([]string{"/dev/disk/by-path/ip", portal, "iscsi", iqn, "lun", "0"}, "-")
+}
+
+// loggedIn returns the sorted portals with a session.
+func (f *fakeISCSIAdmin) loggedIn() []string {
+	f.Lock()
+	defer f.Unlock()
+	var portals []string
+	for session := range f.sessions {
+		portals = append(portals, strings.Split(session, ",")[0])
+	}
+	sort.Strings(portals)
+	return portals
+}
+
+func (f *fakeISCSIAdmin) Run(args ...string) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	opts := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--login", "--logout", "--discover", "-R":
+			opts[args[i]] = "true"
+		default:
+			if i+1 < len(args) {
+				opts[args[i]] = args[i+1]
+				i++
+			}
+		}
+	}
+
+	switch opts["-m"] {
+	case "iface":
+		return f.runIface(opts)
+	case "discoverydb":
+		return f.runDiscovery(opts)
+	case "node":
+		return f.runNode(opts)
+	}
+	return nil, fmt.Errorf("fake iscsiadm: unsupported invocation %v", args)
+}
+
+func (f *fakeISCSIAdmin) runIface(opts map[string]string) ([]byte, error) {
+	iface := opts["-I"]
+	switch opts["-o"] {
+	case "show":
+		if iface != "default" && !f.ifaces[iface] {
+			return []byte("iscsiadm: Could not read iface " + iface), fmt.Errorf("exit status 6")
+		}
+		return []byte("iface.iscsi_ifacename = " + iface + "\niface.transport_name = tcp\niface.initiatorname = <empty>\n"), nil
+	case "new":
+		f.ifaces[iface] = true
+	case "delete":
+		delete(f.ifaces, iface)
+	}
+	return nil, nil
+}
+
+func (f *fakeISCSIAdmin) runDiscovery(opts map[string]string) ([]byte, error) {
+	tp := opts["-p"]
+	switch {
+	case opts["-o"] == "new", opts["-o"] == "update":
+		f.discovery[tp] = true
+		return nil, nil
+	case opts["-o"] == "delete":
+		delete(f.discovery, tp)
+		return nil, nil
+	case opts["--discover"] != "":
+		portal, ok := f.portals[tp]
+		if !ok || portal.down {
+			return []byte("iscsiadm: cannot make connection to " + tp + ": No route to host"), fmt.Errorf("exit status 4")
+		}
+		for _, iqn := range portal.targets {
+			key := tp + "," + iqn
+			if f.nodes[key] == nil {
+				f.nodes[key] = map[string]string{}
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("fake iscsiadm: unsupported discoverydb invocation %v", opts)
+}
+
+func (f *fakeISCSIAdmin) runNode(opts map[string]string) ([]byte, error) {
+	tp, iqn := opts["-p"], opts["-T"]
+	key := tp + "," + iqn
+	switch {
+	case opts["-R"] != "":
+		if !f.sessions[key] {
+			return []byte("iscsiadm: No session found."), fmt.Errorf("exit status 21")
+		}
+		return nil, nil
+	case opts["-o"] == "update":
+		node, ok := f.nodes[key]
+		if !ok {
+			return []byte("iscsiadm: No records found"), fmt.Errorf("exit status 21")
+		}
+		node[opts["-n"]] = opts["-v"]
+		return nil, nil
+	case opts["-o"] == "delete":
+		delete(f.nodes, key)
+		return nil, nil
+	case opts["--login"] != "":
+		node, ok := f.nodes[key]
+		if !ok {
+			return []byte("iscsiadm: No records found"), fmt.Errorf("exit status 21")
+		}
+		portal := f.portals[tp]
+		if portal.down {
+			return []byte("iscsiadm: Could not login to [iface: default, target: " + iqn + ", portal: " + tp + "]: No route to host"), fmt.Errorf("exit status 8")
+		}
+		if portal.chapUser != "" && (node["node.session.auth.username"] != portal.chapUser || node["node.session.auth.password"] != portal.chapPassword) {
+			return []byte("iscsiadm: initiator reported error (24 - iSCSI login failed due to authorization failure)"), fmt.Errorf("exit status 24")
+		}
+		f.sessions[key] = true
+		f.fs.addDevice(fakeDevicePath(tp, iqn), portal.deviceDelay)
+		return nil, nil
+	case opts["--logout"] != "":
+		if !f.sessions[key] {
+			return []byte("iscsiadm: No matching sessions found"), fmt.Errorf("exit status 21")
+		}
+		delete(f.sessions, key)
+		f.fs.removeDevice(fakeDevicePath(tp, iqn))
+		return nil, nil
+	}
+	return nil, fmt.Errorf("fake iscsiadm: unsupported node invocation %v", opts)
+}
+
+// fakeFilesystem holds the device nodes of fakeISCSIAdmin.
+type fakeFilesystem struct {
+	sync.Mutex
+	// devices maps a device node to the number of lookups left until it
+	// appears.
+	devices map[string]int
+}
+
+func newFakeFilesystem() *fakeFilesystem {
+	return &fakeFilesystem{devices: map[string]int{}}
+}
+
+func (fs *fakeFilesystem) addDevice(name string, delay int) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.devices[name] = delay
+}
+
+func (fs *fakeFilesystem) removeDevice(name string) {
+	fs.Lock()
+	defer fs.Unlock()
+	delete(fs.devices, name)
+}
+
+func (fs *fakeFilesystem) exists(name string) bool {
+	fs.Lock()
+	defer fs.Unlock()
+	delay, ok := fs.devices[name]
+	if !ok {
+		return false
+	}
+	if delay > 0 {
+		fs.devices[name] = delay - 1
+		return false
+	}
+	return true
+}
+
+func (fs *fakeFilesystem) Stat(name string) (os.FileInfo, error) {
+	if !fs.exists(name) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return nil, nil
+}
+
+func (fs *fakeFilesystem) Glob(pattern string) ([]string, error) {
+	fs.Lock()
+	var names []string
+	for name := range fs.devices {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	fs.Unlock()
+
+	var matches []string
+	for _, name := range names {
+		if fs.exists(name) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// fakeDeviceUtil maps the devices of fakeFilesystem to a multipath device if
+// multipath is set.
+type fakeDeviceUtil struct {
+	fs        *fakeFilesystem
+	multipath bool
+}
+
+func (d *fakeDeviceUtil) FindMultipathDeviceForDevice(disk string) string {
+	if d.multipath && d.fs.exists(disk) {
+		return "/dev/dm-0"
+	}
+	return ""
+}
+
+func (d *fakeDeviceUtil) FindSlaveDevicesOnMultipath(disk string) []string {
+	return nil
+}
+
+func (d *fakeDeviceUtil) GetISCSIPortalHostMapForTarget(targetIqn string) (map[string]int, error) {
+	return nil, nil
+}
+
+func (d *fakeDeviceUtil) FindDevicesForISCSILun(targetIqn string, lun int) ([]string, error) {
+	return nil, nil
+}
@@ -22,11 +22,16 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
 	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/volume/util"
 )
 
-func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
+// getISCSIInfo returns the disk described by the volume context of req. CHAP
+// credentials are taken from the stage secrets. Reading them from the
+// "secret" key of the volume context, which exposes them in the
+// PersistentVolume, is only allowed if legacySecrets is set.
+func getISCSIInfo(req *csi.NodeStageVolumeRequest, legacySecrets bool) (*iscsiDisk, error) {
 	volName := req.GetVolumeId()
 	tp := req.GetVolumeContext()["targetPortal"]
 	iqn := req.GetVolumeContext()["iqn"]
@@ -36,16 +41,26 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 	}
 
 	portalList := req.GetVolumeContext()["portals"]
-	secretParams := req.GetVolumeContext()["secret"]
-	secret := parseSecret(secretParams)
+	secret := req.GetSecrets()
+	if secretParams, ok := req.GetVolumeContext()["secret"]; ok {
+		if !legacySecrets {
+			return nil, fmt.Errorf("CHAP credentials in the volume context are not supported, pass them as node stage secrets instead")
+		}
+		if len(secret) == 0 {
+			glog.Warningf("iscsi: volume %s reads CHAP credentials from the volume context, which is deprecated", volName)
+			secret = parseSecret(secretParams)
+		}
+	}
 
 	portal := portalMounter(tp)
 	var bkportal []string
 	bkportal = append(bkportal, portal)
 
 	portals := []string{}
-	if err := json.Unmarshal([]byte(portalList), &portals); err != nil {
-		return nil, err
+	if portalList != "" {
+		if err := json.Unmarshal([]byte(portalList), &portals); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, portal := range portals {
@@ -73,33 +88,38 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 		chap_discovery: chapDiscovery,
 		chap_session:   chapSession,
 		secret:         secret,
-		InitiatorName:  initiatorName}, nil
+		InitiatorName:  initiatorName,
+		StagingPath:    req.GetStagingTargetPath()}, nil
 }
 
-func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodePublishVolumeRequest) *iscsiDiskMounter {
-	readOnly := req.GetReadonly()
+// getISCSIDiskMounter returns a mounter which attaches the disk and mounts it
+// at the staging path. The disk is always staged read-write; read-only
+// access is applied when the staging path is bind-mounted on publish. Raw
+// block volumes are attached only.
+func (ns *nodeServer) getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodeStageVolumeRequest) *iscsiDiskMounter {
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 
 	return &iscsiDiskMounter{
 		iscsiDisk:    iscsiInfo,
 		fsType:       fsType,
-		readOnly:     readOnly,
 		mountOptions: mountOptions,
-		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()},
-		exec:         mount.NewOsExec(),
-		targetPath:   req.GetTargetPath(),
-		deviceUtil:   util.NewDeviceHandler(util.NewIOHandler()),
+		isBlock:      req.GetVolumeCapability().GetBlock() != nil,
+		mounter:      &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: ns.exec},
+		iscsiadm:     ns.iscsiadm,
+		fs:           ns.fs,
+		targetPath:   req.GetStagingTargetPath(),
+		deviceUtil:   ns.deviceUtil,
 	}
 }
 
-func getISCSIDiskUnmounter(req *csi.NodeUnpublishVolumeRequest) *iscsiDiskUnmounter {
+func (ns *nodeServer) getISCSIDiskUnmounter(req *csi.NodeUnstageVolumeRequest) *iscsiDiskUnmounter {
 	return &iscsiDiskUnmounter{
 		iscsiDisk: &iscsiDisk{
 			VolName: req.GetVolumeId(),
 		},
-		mounter: mount.New(""),
-		exec:    mount.NewOsExec(),
+		mounter:  ns.mounter,
+		iscsiadm: ns.iscsiadm,
 	}
 }
 
@@ -128,6 +148,13 @@ type iscsiDisk struct {
 	secret         map[string]string
 	InitiatorName  string
 	VolName        string
+	// BlockMode is set for raw block volumes, which are attached without
+	// being formatted or mounted.
+	BlockMode bool
+	// DevicePath is the device a raw block volume is published from.
+	DevicePath string
+	// StagingPath is where the volume is staged on this node.
+	StagingPath string
 }
 
 type iscsiDiskMounter struct {
@@ -135,14 +162,16 @@ type iscsiDiskMounter struct {
 	readOnly     bool
 	fsType       string
 	mountOptions []string
+	isBlock      bool
 	mounter      *mount.SafeFormatAndMount
-	exec         mount.Exec
+	iscsiadm     iscsiAdmin
+	fs           filesystem
 	deviceUtil   util.DeviceUtil
 	targetPath   string
 }
 
 type iscsiDiskUnmounter struct {
 	*iscsiDisk
-	mounter mount.Interface
-	exec    mount.Exec
+	mounter  mount.Interface
+	iscsiadm iscsiAdmin
 }
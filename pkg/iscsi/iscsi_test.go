@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetISCSIInfo(t *testing.T) {
+	stageSecret := map[string]string{
+		"node.session.auth.username": "user",
+		"node.session.auth.password": "secret",
+	}
+	legacySecret := `{"node.session.auth.username": "legacy", "node.session.auth.password": "other"}`
+
+	testCases := []struct {
+		name string
+		// volumeContext is merged into a valid volume context.
+		volumeContext map[string]string
+		secrets       map[string]string
+		legacySecrets bool
+		expectedError bool
+		// expectedSecret is the CHAP secret of the disk.
+		expectedSecret map[string]string
+	}{
+		{
+			name:          "target missing",
+			volumeContext: map[string]string{"iqn": ""},
+			expectedError: true,
+		},
+		{
+			name: "no credentials",
+		},
+		{
+			name:           "stage secrets",
+			secrets:        stageSecret,
+			expectedSecret: stageSecret,
+		},
+		{
+			name:          "legacy key rejected",
+			volumeContext: map[string]string{"secret": legacySecret},
+			expectedError: true,
+		},
+		{
+			name:          "legacy key rejected with stage secrets",
+			volumeContext: map[string]string{"secret": legacySecret},
+			secrets:       stageSecret,
+			expectedError: true,
+		},
+		{
+			name:          "legacy key",
+			volumeContext: map[string]string{"secret": legacySecret},
+			legacySecrets: true,
+			expectedSecret: map[string]string{
+				"node.session.auth.username": "legacy",
+				"node.session.auth.password": "other",
+			},
+		},
+		{
+			name:           "stage secrets take precedence over legacy key",
+			volumeContext:  map[string]string{"secret": legacySecret},
+			secrets:        stageSecret,
+			legacySecrets:  true,
+			expectedSecret: stageSecret,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			volumeContext := map[string]string{
+				"targetPortal":    "10.0.0.1",
+				"portals":         `["10.0.0.2:3261"]`,
+				"iqn":             testIQN,
+				"lun":             "0",
+				"sessionCHAPAuth": "true",
+			}
+			for k, v := range tc.volumeContext {
+				volumeContext[k] = v
+			}
+
+			disk, err := getISCSIInfo(&csi.NodeStageVolumeRequest{
+				VolumeId:          "vol",
+				StagingTargetPath: "/staging",
+				VolumeContext:     volumeContext,
+				Secrets:           tc.secrets,
+			}, tc.legacySecrets)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"10.0.0.1:3260", "10.0.0.2:3261"}, disk.Portals)
+			assert.Equal(t, testIQN, disk.Iqn)
+			// The staging path is recorded for reconcile
+			assert.Equal(t, "/staging", disk.StagingPath)
+			assert.True(t, disk.chap_session)
+			assert.Equal(t, len(tc.expectedSecret), len(disk.secret))
+			for k, v := range tc.expectedSecret {
+				assert.Equal(t, v, disk.secret[k])
+			}
+		})
+	}
+}
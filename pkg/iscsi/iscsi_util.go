@@ -19,6 +19,8 @@ package iscsi
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -49,7 +51,7 @@ func updateISCSIDiscoverydb(b iscsiDiskMounter, tp string) error {
 	if !b.chap_discovery {
 		return nil
 	}
-	out, err := b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "update", "-n", "discovery.sendtargets.auth.authmethod", "-v", "CHAP")
+	out, err := b.iscsiadm.Run("-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "update", "-n", "discovery.sendtargets.auth.authmethod", "-v", "CHAP")
 	if err != nil {
 		return fmt.Errorf("iscsi: failed to update discoverydb with CHAP, output: %v", string(out))
 	}
@@ -57,9 +59,10 @@ func updateISCSIDiscoverydb(b iscsiDiskMounter, tp string) error {
 	for _, k := range chap_st {
 		v := b.secret[k]
 		if len(v) > 0 {
-			out, err := b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "update", "-n", k, "-v", v)
+			out, err := b.iscsiadm.Run("-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "update", "-n", k, "-v", v)
 			if err != nil {
-				return fmt.Errorf("iscsi: failed to update discoverydb key %q with value %q error: %v", k, v, string(out))
+				// Never include the value, it is a credential
+				return fmt.Errorf("iscsi: failed to update discoverydb key %q error: %v", k, string(out))
 			}
 		}
 	}
@@ -71,7 +74,7 @@ func updateISCSINode(b iscsiDiskMounter, tp string) error {
 		return nil
 	}
 
-	out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "-o", "update", "-n", "node.session.auth.authmethod", "-v", "CHAP")
+	out, err := b.iscsiadm.Run("-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "-o", "update", "-n", "node.session.auth.authmethod", "-v", "CHAP")
 	if err != nil {
 		return fmt.Errorf("iscsi: failed to update node with CHAP, output: %v", string(out))
 	}
@@ -79,9 +82,10 @@ func updateISCSINode(b iscsiDiskMounter, tp string) error {
 	for _, k := range chap_sess {
 		v := b.secret[k]
 		if len(v) > 0 {
-			out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "-o", "update", "-n", k, "-v", v)
+			out, err := b.iscsiadm.Run("-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "-o", "update", "-n", k, "-v", v)
 			if err != nil {
-				return fmt.Errorf("iscsi: failed to update node session key %q with value %q error: %v", k, v, string(out))
+				// Never include the value, it is a credential
+				return fmt.Errorf("iscsi: failed to update node session key %q error: %v", k, string(out))
 			}
 		}
 	}
@@ -93,9 +97,9 @@ func updateISCSINode(b iscsiDiskMounter, tp string) error {
 type StatFunc func(string) (os.FileInfo, error)
 type GlobFunc func(string) ([]string, error)
 
-func waitForPathToExist(devicePath *string, maxRetries int, deviceTransport string) bool {
+func waitForPathToExist(devicePath *string, maxRetries int, deviceTransport string, fs filesystem) bool {
 	// This makes unit testing a lot easier
-	return waitForPathToExistInternal(devicePath, maxRetries, deviceTransport, os.Stat, filepath.Glob)
+	return waitForPathToExistInternal(devicePath, maxRetries, deviceTransport, fs.Stat, fs.Glob)
 }
 
 func waitForPathToExistInternal(devicePath *string, maxRetries int, deviceTransport string, osStat StatFunc, filepathGlob GlobFunc) bool {
@@ -132,25 +136,55 @@ func waitForPathToExistInternal(devicePath *string, maxRetries int, deviceTransp
 	return false
 }
 
-type ISCSIUtil struct{}
+type ISCSIUtil struct {
+	// stateDir holds the attach config of every volume staged on this
+	// node, keyed by volume ID.
+	stateDir string
+}
+
+// configFile returns the path of the attach config of volume volName.
+func (util *ISCSIUtil) configFile(volName string) string {
+	return filepath.Join(util.stateDir, url.PathEscape(volName)+".json")
+}
 
-func (util *ISCSIUtil) persistISCSI(conf iscsiDisk, mnt string) error {
-	file := path.Join(mnt, conf.VolName+".json")
-	fp, err := os.Create(file)
+func (util *ISCSIUtil) persistISCSI(conf iscsiDisk) error {
+	if err := os.MkdirAll(util.stateDir, 0750); err != nil {
+		return fmt.Errorf("iscsi: create state dir %s err %s", util.stateDir, err)
+	}
+	data, err := json.Marshal(conf)
 	if err != nil {
+		return fmt.Errorf("iscsi: encode err: %v.", err)
+	}
+	// Replace the file atomically so a crash never leaves a partial config
+	file := util.configFile(conf.VolName)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
 		return fmt.Errorf("iscsi: create %s err %s", file, err)
 	}
-	defer fp.Close()
-	encoder := json.NewEncoder(fp)
-	if err = encoder.Encode(conf); err != nil {
-		return fmt.Errorf("iscsi: encode err: %v.", err)
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return fmt.Errorf("iscsi: rename %s err %s", file, err)
+	}
+	return nil
+}
+
+func (util *ISCSIUtil) loadISCSI(conf *iscsiDisk) error {
+	return decodeISCSI(conf, util.configFile(conf.VolName))
+}
+
+// loadLegacyISCSI loads the config of a volume staged by an earlier version
+// of the driver, which kept it underneath the mount in the staging path.
+func (util *ISCSIUtil) loadLegacyISCSI(conf *iscsiDisk, mnt string) error {
+	return decodeISCSI(conf, path.Join(mnt, conf.VolName+".json"))
+}
+
+func (util *ISCSIUtil) removeISCSI(volName string) error {
+	file := util.configFile(volName)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("iscsi: remove %s err %s", file, err)
 	}
 	return nil
 }
 
-func (util *ISCSIUtil) loadISCSI(conf *iscsiDisk, mnt string) error {
-	// NOTE: The iscsi config json is not deleted after logging out from target portals.
-	file := path.Join(mnt, conf.VolName+".json")
+func decodeISCSI(conf *iscsiDisk, file string) error {
 	fp, err := os.Open(file)
 	if err != nil {
 		return fmt.Errorf("iscsi: open %s err %s", file, err)
@@ -169,7 +203,7 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	var iscsiTransport string
 	var lastErr error
 
-	out, err := b.exec.Run("iscsiadm", "-m", "iface", "-I", b.Iface, "-o", "show")
+	out, err := b.iscsiadm.Run("-m", "iface", "-I", b.Iface, "-o", "show")
 	if err != nil {
 		glog.Errorf("iscsi: could not read iface %s error: %s", b.Iface, string(out))
 		return "", err
@@ -195,7 +229,7 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	for _, tp := range bkpPortal {
 		// Rescan sessions to discover newly mapped LUNs. Do not specify the interface when rescanning
 		// to avoid establishing additional sessions to the same target.
-		out, err := b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-R")
+		out, err := b.iscsiadm.Run("-m", "node", "-p", tp, "-T", b.Iqn, "-R")
 		if err != nil {
 			glog.Errorf("iscsi: failed to rescan session with error: %s (%v)", string(out), err)
 		}
@@ -210,23 +244,23 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 			devicePath = strings.Join([]string{"/dev/disk/by-path/pci", "*", "ip", tp, "iscsi", b.Iqn, "lun", b.lun}, "-")
 		}
 
-		if exist := waitForPathToExist(&devicePath, 1, iscsiTransport); exist {
+		if exist := waitForPathToExist(&devicePath, 1, iscsiTransport, b.fs); exist {
 			glog.V(4).Infof("iscsi: devicepath (%s) exists", devicePath)
 			devicePaths = append(devicePaths, devicePath)
 			continue
 		}
 		// build discoverydb and discover iscsi target
-		b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "new")
+		b.iscsiadm.Run("-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "new")
 		// update discoverydb with CHAP secret
 		err = updateISCSIDiscoverydb(b, tp)
 		if err != nil {
 			lastErr = fmt.Errorf("iscsi: failed to update discoverydb to portal %s error: %v", tp, err)
 			continue
 		}
-		out, err = b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "--discover")
+		out, err = b.iscsiadm.Run("-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "--discover")
 		if err != nil {
 			// delete discoverydb record
-			b.exec.Run("iscsiadm", "-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "delete")
+			b.iscsiadm.Run("-m", "discoverydb", "-t", "sendtargets", "-p", tp, "-I", b.Iface, "-o", "delete")
 			lastErr = fmt.Errorf("iscsi: failed to sendtargets to portal %s output: %s, err %v", tp, string(out), err)
 			continue
 		}
@@ -237,14 +271,14 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 			continue
 		}
 		// login to iscsi target
-		out, err = b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "--login")
+		out, err = b.iscsiadm.Run("-m", "node", "-p", tp, "-T", b.Iqn, "-I", b.Iface, "--login")
 		if err != nil {
 			// delete the node record from database
-			b.exec.Run("iscsiadm", "-m", "node", "-p", tp, "-I", b.Iface, "-T", b.Iqn, "-o", "delete")
+			b.iscsiadm.Run("-m", "node", "-p", tp, "-I", b.Iface, "-T", b.Iqn, "-o", "delete")
 			lastErr = fmt.Errorf("iscsi: failed to attach disk: Error: %s (%v)", string(out), err)
 			continue
 		}
-		if exist := waitForPathToExist(&devicePath, 10, iscsiTransport); !exist {
+		if exist := waitForPathToExist(&devicePath, 10, iscsiTransport, b.fs); !exist {
 			glog.Errorf("Could not attach disk: Timeout after 10s")
 			// update last error
 			lastErr = fmt.Errorf("Could not attach disk: Timeout after 10s")
@@ -256,7 +290,7 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 
 	if len(devicePaths) == 0 {
 		// delete cloned iface
-		b.exec.Run("iscsiadm", "-m", "iface", "-I", b.Iface, "-o", "delete")
+		b.iscsiadm.Run("-m", "iface", "-I", b.Iface, "-o", "delete")
 		glog.Errorf("iscsi: failed to get any path for iscsi disk, last err seen:\n%v", lastErr)
 		return "", fmt.Errorf("failed to get any path for iscsi disk, last err seen:\n%v", lastErr)
 	}
@@ -267,6 +301,10 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	// Make sure we use a valid devicepath to find mpio device.
 	devicePath = devicePaths[0]
 
+	if b.isBlock {
+		return util.attachBlockDisk(b, devicePaths)
+	}
+
 	// Mount device
 	mntPath := b.targetPath
 	notMnt, err := b.mounter.IsLikelyNotMountPoint(mntPath)
@@ -284,23 +322,13 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	}
 
 	// Persist iscsi disk config to json file for DetachDisk path
-	if err := util.persistISCSI(*(b.iscsiDisk), b.targetPath); err != nil {
+	if err := util.persistISCSI(*(b.iscsiDisk)); err != nil {
 		glog.Errorf("iscsi: failed to save iscsi config with error: %v", err)
 		return "", err
 	}
 
-	for _, path := range devicePaths {
-		// There shouldnt be any empty device paths. However adding this check
-		// for safer side to avoid the possibility of an empty entry.
-		if path == "" {
-			continue
-		}
-		// check if the dev is using mpio and if so mount it via the dm-XX device
-		if mappedDevicePath := b.deviceUtil.FindMultipathDeviceForDevice(path); mappedDevicePath != "" {
-			devicePath = mappedDevicePath
-			break
-		}
-	}
+	// check if the dev is using mpio and if so mount it via the dm-XX device
+	devicePath = findDevicePath(b.deviceUtil, devicePaths)
 
 	var options []string
 
@@ -319,40 +347,95 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter) (string, error) {
 	return devicePath, err
 }
 
+// attachBlockDisk records the device of a raw block volume at the staging
+// path for NodePublishVolume to bind-mount. The device is neither formatted
+// nor mounted.
+func (util *ISCSIUtil) attachBlockDisk(b iscsiDiskMounter, devicePaths []string) (string, error) {
+	devicePath := findDevicePath(b.deviceUtil, devicePaths)
+	if err := os.MkdirAll(b.targetPath, 0750); err != nil {
+		glog.Errorf("iscsi: failed to mkdir %s, error", b.targetPath)
+		return "", err
+	}
+
+	b.iscsiDisk.BlockMode = true
+	b.iscsiDisk.DevicePath = devicePath
+	if err := util.persistISCSI(*(b.iscsiDisk)); err != nil {
+		glog.Errorf("iscsi: failed to save iscsi config with error: %v", err)
+		return "", err
+	}
+	glog.V(4).Infof("iscsi: attached raw block device %s", devicePath)
+	return devicePath, nil
+}
+
+// findDevicePath returns the multipath device of devicePaths if the disk is
+// using mpio, or the first device path otherwise.
+func findDevicePath(deviceUtil volumeutil.DeviceUtil, devicePaths []string) string {
+	for _, path := range devicePaths {
+		if path == "" {
+			continue
+		}
+		if mappedDevicePath := deviceUtil.FindMultipathDeviceForDevice(path); mappedDevicePath != "" {
+			return mappedDevicePath
+		}
+	}
+	return devicePaths[0]
+}
+
 func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error {
-	_, cnt, err := mount.GetDeviceNameFromMount(c.mounter, targetPath)
-	if err != nil {
-		glog.Errorf("iscsi detach disk: failed to get device from mnt: %s\nError: %v", targetPath, err)
-		return err
+	// The config tells how the volume was attached. Raw block volumes are
+	// not mounted at the staging path and can be logged out right away.
+	stateErr := util.loadISCSI(c.iscsiDisk)
+	if stateErr == nil && c.iscsiDisk.BlockMode {
+		glog.V(4).Infof("iscsi: detaching raw block device %s", c.iscsiDisk.DevicePath)
+		return util.logoutDisk(c, targetPath)
 	}
 
-	if pathExists, pathErr := volumeutil.PathExists(targetPath); pathErr != nil {
+	pathExists, pathErr := volumeutil.PathExists(targetPath)
+	if pathErr != nil {
 		return fmt.Errorf("Error checking if path exists: %v", pathErr)
-	} else if !pathExists {
-		glog.Warningf("Warning: Unmount skipped because path does not exist: %v", targetPath)
-		return nil
 	}
-	if err = c.mounter.Unmount(targetPath); err != nil {
-		glog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
-		return err
+	if pathExists {
+		notMnt, err := c.mounter.IsLikelyNotMountPoint(targetPath)
+		if err != nil {
+			return fmt.Errorf("Heuristic determination of mount point failed:%v", err)
+		}
+		if !notMnt {
+			_, cnt, err := mount.GetDeviceNameFromMount(c.mounter, targetPath)
+			if err != nil {
+				glog.Errorf("iscsi detach disk: failed to get device from mnt: %s\nError: %v", targetPath, err)
+				return err
+			}
+			if err = c.mounter.Unmount(targetPath); err != nil {
+				glog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
+				return err
+			}
+			cnt--
+			if cnt != 0 {
+				return nil
+			}
+		}
 	}
-	cnt--
-	if cnt != 0 {
-		return nil
+
+	if stateErr != nil {
+		if err := util.loadLegacyISCSI(c.iscsiDisk, targetPath); err != nil {
+			if !pathExists {
+				glog.Warningf("Warning: Detach skipped because neither the path nor the iscsi config exists: %v", targetPath)
+				return nil
+			}
+			glog.Errorf("iscsi detach disk: failed to get iscsi config from path %s Error: %v", targetPath, err)
+			return err
+		}
 	}
+	return util.logoutDisk(c, targetPath)
+}
 
-	var bkpPortal []string
-	var volName, iqn, iface, initiatorName string
+// logoutDisk logs out of the portals in the loaded config of c and removes
+// targetPath.
+func (util *ISCSIUtil) logoutDisk(c iscsiDiskUnmounter, targetPath string) error {
+	bkpPortal, iqn, iface, volName := c.iscsiDisk.Portals, c.iscsiDisk.Iqn, c.iscsiDisk.Iface, c.iscsiDisk.VolName
+	initiatorName := c.iscsiDisk.InitiatorName
 	found := true
 
-	// load iscsi disk config from json file
-	if err := util.loadISCSI(c.iscsiDisk, targetPath); err == nil {
-		bkpPortal, iqn, iface, volName = c.iscsiDisk.Portals, c.iscsiDisk.Iqn, c.iscsiDisk.Iface, c.iscsiDisk.VolName
-		initiatorName = c.iscsiDisk.InitiatorName
-	} else {
-		glog.Errorf("iscsi detach disk: failed to get iscsi config from path %s Error: %v", targetPath, err)
-		return err
-	}
 	portals := removeDuplicate(bkpPortal)
 	if len(portals) == 0 {
 		return fmt.Errorf("iscsi detach disk: failed to detach iscsi disk. Couldn't get connected portals from configurations.")
@@ -366,13 +449,13 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error
 			deleteArgs = append(deleteArgs, []string{"-I", iface}...)
 		}
 		glog.Infof("iscsi: log out target %s iqn %s iface %s", portal, iqn, iface)
-		out, err := c.exec.Run("iscsiadm", logoutArgs...)
+		out, err := c.iscsiadm.Run(logoutArgs...)
 		if err != nil {
 			glog.Errorf("iscsi: failed to detach disk Error: %s", string(out))
 		}
 		// Delete the node record
 		glog.Infof("iscsi: delete node record target %s iqn %s", portal, iqn)
-		out, err = c.exec.Run("iscsiadm", deleteArgs...)
+		out, err = c.iscsiadm.Run(deleteArgs...)
 		if err != nil {
 			glog.Errorf("iscsi: failed to delete node record Error: %s", string(out))
 		}
@@ -381,7 +464,7 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error
 	// If the iface is not created via iscsi plugin, skip to delete
 	if initiatorName != "" && found && iface == (portals[0]+":"+volName) {
 		deleteArgs := []string{"-m", "iface", "-I", iface, "-o", "delete"}
-		out, err := c.exec.Run("iscsiadm", deleteArgs...)
+		out, err := c.iscsiadm.Run(deleteArgs...)
 		if err != nil {
 			glog.Errorf("iscsi: failed to delete iface Error: %s", string(out))
 		}
@@ -391,6 +474,10 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath string) error
 		glog.Errorf("iscsi: failed to remove mount path Error: %v", err)
 		return err
 	}
+	if err := util.removeISCSI(volName); err != nil {
+		glog.Errorf("iscsi: failed to remove iscsi config Error: %v", err)
+		return err
+	}
 
 	return nil
 }
@@ -445,7 +532,7 @@ func parseIscsiadmShow(output string) (map[string]string, error) {
 func cloneIface(b iscsiDiskMounter, newIface string) error {
 	var lastErr error
 	// get pre-configured iface records
-	out, err := b.exec.Run("iscsiadm", "-m", "iface", "-I", b.Iface, "-o", "show")
+	out, err := b.iscsiadm.Run("-m", "iface", "-I", b.Iface, "-o", "show")
 	if err != nil {
 		lastErr = fmt.Errorf("iscsi: failed to show iface records: %s (%v)", string(out), err)
 		return lastErr
@@ -459,16 +546,16 @@ func cloneIface(b iscsiDiskMounter, newIface string) error {
 	// update initiatorname
 	params["iface.initiatorname"] = b.InitiatorName
 	// create new iface
-	out, err = b.exec.Run("iscsiadm", "-m", "iface", "-I", newIface, "-o", "new")
+	out, err = b.iscsiadm.Run("-m", "iface", "-I", newIface, "-o", "new")
 	if err != nil {
 		lastErr = fmt.Errorf("iscsi: failed to create new iface: %s (%v)", string(out), err)
 		return lastErr
 	}
 	// update new iface records
 	for key, val := range params {
-		_, err = b.exec.Run("iscsiadm", "-m", "iface", "-I", newIface, "-o", "update", "-n", key, "-v", val)
+		_, err = b.iscsiadm.Run("-m", "iface", "-I", newIface, "-o", "update", "-n", key, "-v", val)
 		if err != nil {
-			b.exec.Run("iscsiadm", "-m", "iface", "-I", newIface, "-o", "delete")
+			b.iscsiadm.Run("-m", "iface", "-I", newIface, "-o", "delete")
 			lastErr = fmt.Errorf("iscsi: failed to update iface records: %s (%v). iface(%s) will be used", string(out), err, b.Iface)
 			break
 		}
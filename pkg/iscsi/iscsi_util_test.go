@@ -0,0 +1,367 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+const (
+	testIQN     = "iqn.2019-01.io.k8s:storage.target0"
+	testPortal1 = "10.0.0.1:3260"
+	testPortal2 = "10.0.0.2:3260"
+)
+
+// newFakeDiskMounter returns a mounter attaching the raw block volume "vol"
+// from portals through adm, with its state kept below dir.
+func newFakeDiskMounter(dir string, adm *fakeISCSIAdmin, multipath bool, portals ...string) (*ISCSIUtil, iscsiDiskMounter) {
+	stagingPath := filepath.Join(dir, "staging")
+	util := &ISCSIUtil{stateDir: filepath.Join(dir, "state")}
+	b := iscsiDiskMounter{
+		iscsiDisk: &iscsiDisk{
+			VolName:     "vol",
+			Portals:     portals,
+			Iqn:         testIQN,
+			lun:         "0",
+			Iface:       "default",
+			StagingPath: stagingPath,
+		},
+		isBlock:    true,
+		mounter:    &mount.SafeFormatAndMount{Interface: &mount.FakeMounter{}},
+		iscsiadm:   adm,
+		fs:         adm.fs,
+		deviceUtil: &fakeDeviceUtil{fs: adm.fs, multipath: multipath},
+		targetPath: stagingPath,
+	}
+	return util, b
+}
+
+func TestAttachDisk(t *testing.T) {
+	chapSecret := map[string]string{
+		"node.session.auth.username": "user",
+		"node.session.auth.password": "secret",
+	}
+
+	testCases := []struct {
+		name        string
+		portals     map[string]*fakePortal
+		multipath   bool
+		chapSession bool
+		secret      map[string]string
+		// expectedDevice is empty if the attach is expected to fail.
+		expectedDevice   string
+		expectedSessions []string
+	}{
+		{
+			name: "single portal",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}},
+			},
+			expectedDevice:   fakeDevicePath(testPortal1, testIQN),
+			expectedSessions: []string{testPortal1},
+		},
+		{
+			name: "multipath",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}},
+				testPortal2: {targets: []string{testIQN}},
+			},
+			multipath:        true,
+			expectedDevice:   "/dev/dm-0",
+			expectedSessions: []string{testPortal1, testPortal2},
+		},
+		{
+			name: "partial login",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}},
+				testPortal2: {targets: []string{testIQN}, down: true},
+			},
+			multipath:        true,
+			expectedDevice:   "/dev/dm-0",
+			expectedSessions: []string{testPortal1},
+		},
+		{
+			name: "failover to second portal",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}, down: true},
+				testPortal2: {targets: []string{testIQN}},
+			},
+			expectedDevice:   fakeDevicePath(testPortal2, testIQN),
+			expectedSessions: []string{testPortal2},
+		},
+		{
+			name: "all portals down",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}, down: true},
+				testPortal2: {targets: []string{testIQN}, down: true},
+			},
+		},
+		{
+			name: "target not exported",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{"iqn.2019-01.io.k8s:storage.other"}},
+			},
+		},
+		{
+			name: "device appears late",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}, deviceDelay: 1},
+			},
+			expectedDevice:   fakeDevicePath(testPortal1, testIQN),
+			expectedSessions: []string{testPortal1},
+		},
+		{
+			name: "CHAP",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}, chapUser: "user", chapPassword: "secret"},
+			},
+			chapSession:      true,
+			secret:           chapSecret,
+			expectedDevice:   fakeDevicePath(testPortal1, testIQN),
+			expectedSessions: []string{testPortal1},
+		},
+		{
+			name: "CHAP failure",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}, chapUser: "user", chapPassword: "other"},
+			},
+			chapSession: true,
+			secret:      chapSecret,
+		},
+		{
+			name: "CHAP credentials missing",
+			portals: map[string]*fakePortal{
+				testPortal1: {targets: []string{testIQN}, chapUser: "user", chapPassword: "secret"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "iscsi-attach")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			adm := newFakeISCSIAdmin(tc.portals)
+			util, b := newFakeDiskMounter(dir, adm, tc.multipath, testPortal1, testPortal2)
+			if len(tc.portals) == 1 {
+				b.Portals = []string{testPortal1}
+			}
+			b.chap_session = tc.chapSession
+			b.secret = tc.secret
+
+			devicePath, err := util.AttachDisk(b)
+			if tc.expectedDevice == "" {
+				assert.Error(t, err)
+				assert.Empty(t, adm.loggedIn())
+				// Node records of failed logins are removed
+				for _, tp := range b.Portals {
+					assert.NotContains(t, adm.nodes, tp+","+testIQN)
+				}
+				_, err := os.Stat(util.configFile("vol"))
+				assert.True(t, os.IsNotExist(err), "config of a failed attach must not be kept")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedDevice, devicePath)
+			assert.Equal(t, tc.expectedSessions, adm.loggedIn())
+
+			conf := &iscsiDisk{VolName: "vol"}
+			assert.NoError(t, util.loadISCSI(conf))
+			assert.True(t, conf.BlockMode)
+			assert.Equal(t, tc.expectedDevice, conf.DevicePath)
+		})
+	}
+}
+
+func TestAttachDiskLoggedIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-attach")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The target is down, but the session from an earlier attach is intact
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}, down: true},
+	})
+	adm.sessions[testPortal1+","+testIQN] = true
+	adm.fs.addDevice(fakeDevicePath(testPortal1, testIQN), 0)
+
+	util, b := newFakeDiskMounter(dir, adm, false, testPortal1)
+	devicePath, err := util.AttachDisk(b)
+	assert.NoError(t, err)
+	assert.Equal(t, fakeDevicePath(testPortal1, testIQN), devicePath)
+}
+
+func TestAttachDiskClonedIface(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-attach")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}, down: true},
+	})
+	util, b := newFakeDiskMounter(dir, adm, false, testPortal1)
+	b.InitiatorName = "iqn.2019-01.io.k8s:node"
+
+	_, err = util.AttachDisk(b)
+	assert.Error(t, err)
+	// The iface cloned for the initiator name is removed again
+	assert.Empty(t, adm.ifaces)
+}
+
+func TestDetachDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-detach")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+		testPortal2: {targets: []string{testIQN}},
+	})
+	util, b := newFakeDiskMounter(dir, adm, true, testPortal1, testPortal2)
+	_, err = util.AttachDisk(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testPortal1, testPortal2}, adm.loggedIn())
+
+	c := iscsiDiskUnmounter{
+		iscsiDisk: &iscsiDisk{VolName: "vol"},
+		mounter:   &mount.FakeMounter{},
+		iscsiadm:  adm,
+	}
+	assert.NoError(t, util.DetachDisk(c, b.targetPath))
+	assert.Empty(t, adm.loggedIn())
+	assert.Empty(t, adm.nodes)
+	_, err = os.Stat(b.targetPath)
+	assert.True(t, os.IsNotExist(err), "staging path must be removed")
+	_, err = os.Stat(util.configFile("vol"))
+	assert.True(t, os.IsNotExist(err), "config must be removed")
+
+	// Detaching again succeeds
+	c.iscsiDisk = &iscsiDisk{VolName: "vol"}
+	assert.NoError(t, util.DetachDisk(c, b.targetPath))
+}
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-reconcile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+	})
+	util, b := newFakeDiskMounter(dir, adm, false, testPortal1)
+	_, err = util.AttachDisk(b)
+	assert.NoError(t, err)
+
+	// The volume is still staged
+	util.reconcile(&mount.FakeMounter{}, adm)
+	assert.Equal(t, []string{testPortal1}, adm.loggedIn())
+
+	// The staging path went away while the driver was down
+	assert.NoError(t, os.RemoveAll(b.targetPath))
+	util.reconcile(&mount.FakeMounter{}, adm)
+	assert.Empty(t, adm.loggedIn())
+	_, err = os.Stat(util.configFile("vol"))
+	assert.True(t, os.IsNotExist(err), "config must be removed")
+}
+
+func TestISCSIConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	util := &ISCSIUtil{stateDir: filepath.Join(dir, "state")}
+	// Volume IDs are escaped so they cannot leave the state dir
+	conf := iscsiDisk{VolName: "../vol/1", Iqn: testIQN, Portals: []string{testPortal1}, StagingPath: "/staging"}
+	assert.NoError(t, util.persistISCSI(conf))
+	files, err := filepath.Glob(filepath.Join(util.stateDir, "*.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{util.configFile(conf.VolName)}, files)
+
+	loaded := &iscsiDisk{VolName: conf.VolName}
+	assert.NoError(t, util.loadISCSI(loaded))
+	assert.Equal(t, conf, *loaded)
+
+	assert.NoError(t, util.removeISCSI(conf.VolName))
+	assert.Error(t, util.loadISCSI(&iscsiDisk{VolName: conf.VolName}))
+	// Removing a missing config succeeds
+	assert.NoError(t, util.removeISCSI(conf.VolName))
+}
+
+func TestDetachDiskLegacyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-detach")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+	})
+	util, b := newFakeDiskMounter(dir, adm, false, testPortal1)
+	_, err = util.AttachDisk(b)
+	assert.NoError(t, err)
+
+	// Earlier versions kept the config at the staging path
+	legacy := &iscsiDisk{VolName: "vol", Iqn: testIQN, Portals: []string{testPortal1}, Iface: "default"}
+	data, err := json.Marshal(legacy)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(b.targetPath, "vol.json"), data, 0600))
+	assert.NoError(t, util.removeISCSI("vol"))
+
+	c := iscsiDiskUnmounter{
+		iscsiDisk: &iscsiDisk{VolName: "vol"},
+		mounter:   &mount.FakeMounter{},
+		iscsiadm:  adm,
+	}
+	assert.NoError(t, util.DetachDisk(c, b.targetPath))
+	assert.Empty(t, adm.loggedIn())
+	_, err = os.Stat(b.targetPath)
+	assert.True(t, os.IsNotExist(err), "staging path must be removed")
+}
+
+func TestReconcileFilesystemVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iscsi-reconcile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+	})
+	util, b := newFakeDiskMounter(dir, adm, false, testPortal1)
+	b.isBlock = false
+	b.mounter.Exec = mount.NewFakeExec(nil)
+	_, err = util.AttachDisk(b)
+	assert.NoError(t, err)
+	mounter := b.mounter.Interface
+
+	// The volume is still mounted at the staging path
+	util.reconcile(mounter, adm)
+	assert.Equal(t, []string{testPortal1}, adm.loggedIn())
+
+	// The staging path was unmounted while the driver was down
+	assert.NoError(t, mounter.Unmount(b.targetPath))
+	util.reconcile(mounter, adm)
+	assert.Empty(t, adm.loggedIn())
+	_, err = os.Stat(util.configFile("vol"))
+	assert.True(t, os.IsNotExist(err), "config must be removed")
+}
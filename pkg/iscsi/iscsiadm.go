@@ -0,0 +1,59 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"os"
+	"path/filepath"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// iscsiAdmin runs iscsiadm, the open-iscsi administration tool, and returns
+// its combined output. Tests replace it to simulate an initiator.
+type iscsiAdmin interface {
+	Run(args ...string) ([]byte, error)
+}
+
+type execISCSIAdmin struct {
+	exec mount.Exec
+}
+
+func newISCSIAdmin() iscsiAdmin {
+	return &execISCSIAdmin{exec: mount.NewOsExec()}
+}
+
+func (a *execISCSIAdmin) Run(args ...string) ([]byte, error) {
+	return a.exec.Run("iscsiadm", args...)
+}
+
+// filesystem looks up the device nodes which appear once a session is logged
+// in. Tests replace it to simulate devices.
+type filesystem interface {
+	Stat(name string) (os.FileInfo, error)
+	Glob(pattern string) ([]string, error)
+}
+
+type osFilesystem struct{}
+
+func (fs *osFilesystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (fs *osFilesystem) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
@@ -17,51 +17,205 @@ limitations under the License.
 package iscsi
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume/util"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	mounter   mount.Interface
+	iscsiutil *ISCSIUtil
+	// exec, iscsiadm, fs and deviceUtil reach the initiator and the
+	// devices of the node. Tests replace them.
+	exec       mount.Exec
+	iscsiadm   iscsiAdmin
+	fs         filesystem
+	deviceUtil util.DeviceUtil
+	// legacySecrets allows CHAP credentials in the volume context.
+	legacySecrets bool
 }
 
+// NodePublishVolume bind-mounts the disk staged at the staging path to the
+// target path. Raw block volumes bind-mount the attached device to the
+// target file instead.
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	iscsiInfo, err := getISCSIInfo(req)
-	if err != nil {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return ns.publishBlockVolume(req)
+	}
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	diskMounter := getISCSIDiskMounter(iscsiInfo, req)
+	if err != nil || notMnt {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", req.GetVolumeId(), stagingPath)
+	}
 
-	util := &ISCSIUtil{}
-	_, err = util.AttachDisk(*diskMounter)
+	targetPath := req.GetTargetPath()
+	notMnt, err = ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(targetPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	glog.V(4).Infof("iscsi: bind mounting %s at %s", stagingPath, targetPath)
+	if err := ns.mounter.Mount(stagingPath, targetPath, "", options); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	diskUnmounter := getISCSIDiskUnmounter(req)
+// publishBlockVolume bind-mounts the device recorded when the volume was
+// staged to the target file.
+func (ns *nodeServer) publishBlockVolume(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	conf := &iscsiDisk{VolName: req.GetVolumeId()}
+	if err := ns.iscsiutil.loadISCSI(conf); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s: %v", req.GetVolumeId(), req.GetStagingTargetPath(), err)
+	}
+	if !conf.BlockMode {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume %s was staged with a filesystem and cannot be published as a block device", req.GetVolumeId())
+	}
+
 	targetPath := req.GetTargetPath()
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	f, err := os.OpenFile(targetPath, os.O_CREATE, 0640)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	f.Close()
 
-	iscsiutil := &ISCSIUtil{}
-	err := iscsiutil.DetachDisk(*diskUnmounter, targetPath)
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	glog.V(4).Infof("iscsi: bind mounting device %s at %s", conf.DevicePath, targetPath)
+	if err := ns.mounter.Mount(conf.DevicePath, targetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts the target path and removes it. The disk stays
+// attached until the volume is unstaged.
+func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	if err := util.UnmountPath(req.GetTargetPath(), ns.mounter); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// NodeStageVolume logs in to the target portals, then formats the disk if
+// needed and mounts it at the staging path. All targets on this node share
+// the staged disk. Raw block volumes are attached without being formatted.
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	iscsiInfo, err := getISCSIInfo(req, ns.legacySecrets)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	diskMounter := ns.getISCSIDiskMounter(iscsiInfo, req)
+
+	_, err = ns.iscsiutil.AttachDisk(*diskMounter)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the staging path and logs out of the target
+// portals.
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	diskUnmounter := ns.getISCSIDiskUnmounter(req)
+	stagingPath := req.GetStagingTargetPath()
+
+	err := ns.iscsiutil.DetachDisk(*diskUnmounter, stagingPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	return csicommon.GetVolumeStats(req.GetVolumePath())
 }
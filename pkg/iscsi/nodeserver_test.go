@@ -0,0 +1,315 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func newFakeNodeServer(t *testing.T) (*nodeServer, string, func()) {
+	dir, err := ioutil.TempDir("", "iscsi-node")
+	assert.NoError(t, err)
+
+	d := NewDriver("fakeNodeID", "unix:///tmp/csi.sock", filepath.Join(dir, "state"), false)
+	return NewNodeServer(d), dir, func() { os.RemoveAll(dir) }
+}
+
+// newFakeInitiatorNodeServer returns a node server whose initiator is
+// simulated by adm, and whose mounts are recorded by the returned mounter.
+func newFakeInitiatorNodeServer(t *testing.T, adm *fakeISCSIAdmin, multipath bool) (*nodeServer, *mount.FakeMounter, string, func()) {
+	ns, dir, cleanup := newFakeNodeServer(t)
+	mounter := &mount.FakeMounter{}
+	ns.mounter = mounter
+	ns.exec = mount.NewFakeExec(nil)
+	ns.iscsiadm = adm
+	ns.fs = adm.fs
+	ns.deviceUtil = &fakeDeviceUtil{fs: adm.fs, multipath: multipath}
+	return ns, mounter, dir, cleanup
+}
+
+func newNodeStageVolumeRequest(stagingPath string, capability *csi.VolumeCapability) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  capability,
+		VolumeContext: map[string]string{
+			"targetPortal":   testPortal1,
+			"iqn":            testIQN,
+			"lun":            "0",
+			"iscsiInterface": "default",
+		},
+	}
+}
+
+func newMountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestNodeStageUnstageVolume(t *testing.T) {
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+	})
+	ns, mounter, dir, cleanup := newFakeInitiatorNodeServer(t, adm, false)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+
+	// Staging logs in and mounts the disk at the staging path
+	req := newNodeStageVolumeRequest(stagingPath, newMountCapability())
+	_, err := ns.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testPortal1}, adm.loggedIn())
+	if assert.Len(t, mounter.MountPoints, 1) {
+		assert.Equal(t, fakeDevicePath(testPortal1, testIQN), mounter.MountPoints[0].Device)
+		assert.Equal(t, stagingPath, mounter.MountPoints[0].Path)
+		assert.Equal(t, "ext4", mounter.MountPoints[0].Type)
+	}
+	// The attach config is kept in the state dir, not underneath the mount
+	_, err = os.Stat(ns.iscsiutil.configFile("vol"))
+	assert.NoError(t, err)
+	files, err := ioutil.ReadDir(stagingPath)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// Staging again reuses the session and the mount
+	_, err = ns.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testPortal1}, adm.loggedIn())
+	assert.Len(t, mounter.MountPoints, 1)
+
+	// Unstaging unmounts and logs out
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.MountPoints)
+	assert.Empty(t, adm.loggedIn())
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "staging path must be removed")
+
+	_, err = os.Stat(ns.iscsiutil.configFile("vol"))
+	assert.True(t, os.IsNotExist(err), "config must be removed")
+
+	// Unstaging again succeeds
+	_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeInvalidArguments(t *testing.T) {
+	ns, dir, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+
+	tests := map[string]*csi.NodeStageVolumeRequest{
+		"capability missing":   newNodeStageVolumeRequest(stagingPath, nil),
+		"staging path missing": newNodeStageVolumeRequest("", newMountCapability()),
+		"target missing": func() *csi.NodeStageVolumeRequest {
+			req := newNodeStageVolumeRequest(stagingPath, newMountCapability())
+			delete(req.VolumeContext, "iqn")
+			return req
+		}(),
+	}
+	for name, req := range tests {
+		_, err := ns.NodeStageVolume(context.Background(), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), name)
+	}
+}
+
+func TestNodePublishStagedVolume(t *testing.T) {
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+	})
+	ns, mounter, dir, cleanup := newFakeInitiatorNodeServer(t, adm, false)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+	target1 := filepath.Join(dir, "target1")
+	target2 := filepath.Join(dir, "target2")
+
+	publishReq := func(target string, readOnly bool) *csi.NodePublishVolumeRequest {
+		return &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol",
+			StagingTargetPath: stagingPath,
+			TargetPath:        target,
+			VolumeCapability:  newMountCapability(),
+			Readonly:          readOnly,
+		}
+	}
+
+	// Publishing requires the volume to be staged
+	_, err := ns.NodePublishVolume(context.Background(), publishReq(target1, false))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = ns.NodeStageVolume(context.Background(), newNodeStageVolumeRequest(stagingPath, newMountCapability()))
+	assert.NoError(t, err)
+
+	// Every target bind-mounts the staged disk without logging in again
+	_, err = ns.NodePublishVolume(context.Background(), publishReq(target1, false))
+	assert.NoError(t, err)
+	_, err = ns.NodePublishVolume(context.Background(), publishReq(target2, true))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testPortal1}, adm.loggedIn())
+	device := fakeDevicePath(testPortal1, testIQN)
+	if assert.Len(t, mounter.MountPoints, 3) {
+		assert.Equal(t, mount.MountPoint{Device: device, Path: target1, Opts: []string{}}, mounter.MountPoints[1])
+		assert.Equal(t, mount.MountPoint{Device: device, Path: target2, Opts: []string{"ro"}}, mounter.MountPoints[2])
+	}
+
+	// Publishing again is idempotent
+	_, err = ns.NodePublishVolume(context.Background(), publishReq(target1, false))
+	assert.NoError(t, err)
+	assert.Len(t, mounter.MountPoints, 3)
+
+	// Unpublishing leaves the disk staged
+	for _, target := range []string{target1, target2} {
+		_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: target})
+		assert.NoError(t, err)
+		_, err = os.Stat(target)
+		assert.True(t, os.IsNotExist(err), "target path must be removed")
+	}
+	assert.Len(t, mounter.MountPoints, 1)
+	assert.Equal(t, []string{testPortal1}, adm.loggedIn())
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, dir, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	// The volume was never published on this node
+	_, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "unknown", VolumePath: filepath.Join(dir, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The volume is not mounted at the path anymore
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol", VolumePath: dir})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumePath: dir})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	ns, _, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	var types []csi.NodeServiceCapability_RPC_Type
+	for _, cap := range resp.GetCapabilities() {
+		types = append(types, cap.GetRpc().GetType())
+	}
+	assert.Contains(t, types, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
+}
+
+func newBlockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestNodeBlockVolume(t *testing.T) {
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+		testPortal2: {targets: []string{testIQN}},
+	})
+	ns, mounter, dir, cleanup := newFakeInitiatorNodeServer(t, adm, true)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "pod", "target")
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  newBlockCapability(),
+	}
+
+	// Publishing requires the volume to be staged
+	_, err := ns.NodePublishVolume(context.Background(), publishReq)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Staging logs in to all portals without formatting or mounting
+	req := newNodeStageVolumeRequest(stagingPath, newBlockCapability())
+	req.VolumeContext["portals"] = `["` + testPortal2 + `"]`
+	_, err = ns.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testPortal1, testPortal2}, adm.loggedIn())
+	assert.Empty(t, mounter.MountPoints)
+
+	// The multipath device is bind-mounted to the target file
+	_, err = ns.NodePublishVolume(context.Background(), publishReq)
+	assert.NoError(t, err)
+	fi, err := os.Stat(targetPath)
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, []mount.MountPoint{{Device: "/dev/dm-0", Path: targetPath, Opts: []string{}}}, mounter.MountPoints)
+
+	// Publishing again is idempotent
+	_, err = ns.NodePublishVolume(context.Background(), publishReq)
+	assert.NoError(t, err)
+	assert.Len(t, mounter.MountPoints, 1)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targetPath})
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.MountPoints)
+	assert.Equal(t, []string{testPortal1, testPortal2}, adm.loggedIn())
+
+	// Unstaging logs out of all portals
+	_, err = ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath})
+	assert.NoError(t, err)
+	assert.Empty(t, adm.loggedIn())
+	assert.Empty(t, adm.nodes)
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err), "staging path must be removed")
+}
+
+func TestNodePublishVolumeAccessTypeMismatch(t *testing.T) {
+	adm := newFakeISCSIAdmin(map[string]*fakePortal{
+		testPortal1: {targets: []string{testIQN}},
+	})
+	ns, _, dir, cleanup := newFakeInitiatorNodeServer(t, adm, false)
+	defer cleanup()
+	stagingPath := filepath.Join(dir, "staging")
+
+	// A volume staged with a filesystem cannot be published as a device
+	_, err := ns.NodeStageVolume(context.Background(), newNodeStageVolumeRequest(stagingPath, newMountCapability()))
+	assert.NoError(t, err)
+	_, err = ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability:  newBlockCapability(),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
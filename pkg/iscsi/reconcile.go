@@ -0,0 +1,72 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iscsi
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// reconcile logs out of the sessions of volumes in the state dir which are
+// not staged anymore, for instance because the unstage request arrived while
+// the driver was down or failed half way. Filesystem volumes are staged while
+// their staging path is mounted, raw block volumes while their staging path
+// exists.
+func (util *ISCSIUtil) reconcile(mounter mount.Interface, iscsiadm iscsiAdmin) {
+	files, err := filepath.Glob(filepath.Join(util.stateDir, "*.json"))
+	if err != nil {
+		glog.Errorf("iscsi: failed to list iscsi configs in %s: %v", util.stateDir, err)
+		return
+	}
+
+	for _, file := range files {
+		conf := &iscsiDisk{}
+		if err := decodeISCSI(conf, file); err != nil {
+			glog.Errorf("iscsi: skipping iscsi config %s: %v", file, err)
+			continue
+		}
+		if isStaged(mounter, conf) {
+			continue
+		}
+
+		glog.Infof("iscsi: volume %s is not staged at %s anymore, logging out", conf.VolName, conf.StagingPath)
+		c := iscsiDiskUnmounter{iscsiDisk: conf, mounter: mounter, iscsiadm: iscsiadm}
+		if err := util.logoutDisk(c, conf.StagingPath); err != nil {
+			glog.Errorf("iscsi: failed to log out volume %s: %v", conf.VolName, err)
+		}
+	}
+}
+
+// isStaged returns true unless conf is known not to be staged anymore.
+func isStaged(mounter mount.Interface, conf *iscsiDisk) bool {
+	if conf.StagingPath == "" {
+		return true
+	}
+	if conf.BlockMode {
+		_, err := os.Stat(conf.StagingPath)
+		return !os.IsNotExist(err)
+	}
+	notMnt, err := mounter.IsLikelyNotMountPoint(conf.StagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningf("iscsi: cannot tell if %s is mounted, keeping volume %s: %v", conf.StagingPath, conf.VolName, err)
+		return true
+	}
+	return err == nil && !notMnt
+}
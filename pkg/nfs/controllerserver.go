@@ -0,0 +1,416 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/kubernetes-csi/drivers/pkg/csi-common"
+)
+
+const (
+	// StorageClass parameters naming the base export volumes are
+	// provisioned in. They match the volume context keys read on publish.
+	paramServer = "server"
+	paramShare  = "share"
+	// paramOnDelete selects what happens to the volume directory when the
+	// volume is deleted.
+	paramOnDelete = "onDelete"
+
+	// onDeleteDelete removes the volume directory. This is the default.
+	onDeleteDelete = "delete"
+	// onDeleteArchive keeps the data by renaming the volume directory to
+	// archived-<name>-<time of deletion>.
+	onDeleteArchive = "archive"
+
+	archivePrefix = "archived-"
+	// archiveTimeFormat is the UTC time suffix of archived directories. It
+	// keeps volumes of the same name from being archived to one directory.
+	archiveTimeFormat = "20060102-150405.000000000"
+
+	// volumeIDSeparator joins the fields of a volume ID. It cannot appear
+	// in a host name or in the volume name chosen by the provisioner.
+	volumeIDSeparator = "#"
+	// mountParamsSeparator separates the mount parameter values in the
+	// volume ID.
+	mountParamsSeparator = ","
+	// maxVolumeIDLength is the maximum length of a volume ID allowed by
+	// the CSI spec.
+	maxVolumeIDLength = 128
+)
+
+type controllerServer struct {
+	*csicommon.DefaultControllerServer
+	mounter mount.Interface
+	// workingMountDir is where base exports are temporarily mounted to
+	// create and delete volume directories.
+	workingMountDir string
+}
+
+// nfsVolume describes a volume provisioned as a subdirectory of a base
+// export. All fields are encoded in the volume ID since DeleteVolume does not
+// receive the StorageClass parameters.
+type nfsVolume struct {
+	server    string
+	baseShare string
+	subDir    string
+	onDelete  string
+	// mountParams holds the mount parameters of the StorageClass. They are
+	// passed on in the volume context, and their values are kept in the
+	// volume ID so that DeleteVolume mounts the base export the same way.
+	mountParams map[string]string
+}
+
+func NewControllerServer(d *driver) *controllerServer {
+	return &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
+		mounter:                 mount.New(""),
+		workingMountDir:         d.workingMountDir,
+	}
+}
+
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("invalid create volume request for %s: %v", req.GetName(), err)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if err := validateVolumeName(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	caps := req.GetVolumeCapabilities()
+	if caps == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+	}
+	if err := validateVolumeCapabilities(caps); err != nil {
+		return nil, err
+	}
+
+	vol, err := newNFSVolume(req.GetName(), req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	// Mount the base export with the mount options of the StorageClass so
+	// the directory is created the same way it will be accessed.
+	var mountFlags []string
+	for _, cap := range caps {
+		mountFlags = append(mountFlags, cap.GetMount().GetMountFlags()...)
+	}
+	mountOptions, err := getMountOptions(vol.mountParams, mountFlags)
+	if err != nil {
+		return nil, err
+	}
+	volumeID := vol.id()
+	if len(volumeID) > maxVolumeIDLength {
+		return nil, status.Errorf(codes.InvalidArgument, "volume id %s is longer than %d bytes, use a shorter server, share or name", volumeID, maxVolumeIDLength)
+	}
+	if err := cs.mountBaseShare(vol, mountOptions); err != nil {
+		return nil, err
+	}
+	defer cs.unmountBaseShare(vol)
+
+	volPath := cs.getInternalVolumePath(vol)
+	glog.V(4).Infof("creating volume directory %s", volPath)
+	if err := os.MkdirAll(volPath, 0777); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create volume directory %s: %v", volPath, err)
+	}
+	// Ignore the umask so that pods running as any user can write to the
+	// volume, like they could with the base export.
+	if err := os.Chmod(volPath, 0777); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to set permissions of volume directory %s: %v", volPath, err)
+	}
+
+	volumeContext := map[string]string{
+		paramServer: vol.server,
+		paramShare:  vol.share(),
+	}
+	for k, v := range vol.mountParams {
+		volumeContext[k] = v
+	}
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			VolumeContext: volumeContext,
+		},
+	}, nil
+}
+
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		glog.V(3).Infof("invalid delete volume request for %s: %v", req.GetVolumeId(), err)
+		return nil, err
+	}
+
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	vol, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		// The volume was not provisioned by this driver, so there is
+		// nothing to delete.
+		glog.Warningf("ignoring delete of unknown volume %s: %v", req.GetVolumeId(), err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	// Exports requiring Kerberos or a particular NFS version can only be
+	// mounted with the parameters the volume was created with.
+	mountOptions, err := getMountOptions(vol.mountParams, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.mountBaseShare(vol, mountOptions); err != nil {
+		return nil, err
+	}
+	defer cs.unmountBaseShare(vol)
+
+	volPath := cs.getInternalVolumePath(vol)
+	if _, err := os.Stat(volPath); os.IsNotExist(err) {
+		glog.V(4).Infof("volume directory %s already deleted", volPath)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	switch vol.onDelete {
+	case onDeleteArchive:
+		archiveName := fmt.Sprintf("%s%s-%s", archivePrefix, vol.subDir, time.Now().UTC().Format(archiveTimeFormat))
+		archivePath := filepath.Join(filepath.Dir(volPath), archiveName)
+		glog.V(4).Infof("archiving volume directory %s to %s", volPath, archivePath)
+		if err := os.Rename(volPath, archivePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to archive volume directory %s: %v", volPath, err)
+		}
+	default:
+		glog.V(4).Infof("removing volume directory %s", volPath)
+		if err := os.RemoveAll(volPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove volume directory %s: %v", volPath, err)
+		}
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetVolumeCapabilities() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
+	}
+	if _, err := parseVolumeID(req.GetVolumeId()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err := validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// mountBaseShare mounts the base export of vol below the working directory.
+func (cs *controllerServer) mountBaseShare(vol *nfsVolume, mountOptions []string) error {
+	target := cs.getInternalMountPath(vol)
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return status.Errorf(codes.Internal, "failed to create working directory %s: %v", target, err)
+	}
+
+	source := fmt.Sprintf("%s:%s", vol.server, vol.baseShare)
+	glog.V(4).Infof("mounting %s at %s", source, target)
+	if err := cs.mounter.Mount(source, target, "nfs", mountOptions); err != nil {
+		os.Remove(target)
+		return status.Errorf(mountErrorCode(err), "failed to mount %s: %v", source, err)
+	}
+	return nil
+}
+
+// unmountBaseShare unmounts the base export of vol and removes the working
+// directory. Failures are only logged since the volume operation itself
+// already succeeded or failed.
+func (cs *controllerServer) unmountBaseShare(vol *nfsVolume) {
+	target := cs.getInternalMountPath(vol)
+	if err := cs.mounter.Unmount(target); err != nil {
+		glog.Errorf("failed to unmount %s: %v", target, err)
+		return
+	}
+	if err := os.Remove(target); err != nil {
+		glog.Errorf("failed to remove working directory %s: %v", target, err)
+	}
+}
+
+// getInternalMountPath returns where the base export of vol is mounted while
+// the volume is created or deleted. Every volume gets its own mount point so
+// concurrent requests do not unmount each other's exports.
+func (cs *controllerServer) getInternalMountPath(vol *nfsVolume) string {
+	return filepath.Join(cs.workingMountDir, vol.subDir)
+}
+
+// getInternalVolumePath returns the path of the volume directory below the
+// mounted base export.
+func (cs *controllerServer) getInternalVolumePath(vol *nfsVolume) string {
+	return filepath.Join(cs.getInternalMountPath(vol), vol.subDir)
+}
+
+// validateVolumeCapabilities rejects capabilities NFS volumes cannot provide.
+func validateVolumeCapabilities(caps []*csi.VolumeCapability) error {
+	for _, cap := range caps {
+		if cap.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "Block access type is not supported")
+		}
+	}
+	return nil
+}
+
+// validateVolumeName checks that name can be used as the volume directory:
+// a single path element below the base export, which must not be the export
+// itself or its parent. Removing the directory of "." would delete every
+// volume on the export.
+func validateVolumeName(name string) error {
+	if strings.Contains(name, volumeIDSeparator) {
+		return fmt.Errorf("name %s must not contain %q", name, volumeIDSeparator)
+	}
+	if name == "." || name == ".." || strings.Contains(name, "/") || path.Clean(name) != name {
+		return fmt.Errorf("name %s must be a single path element other than \".\" and \"..\"", name)
+	}
+	return nil
+}
+
+// newNFSVolume describes how the volume name is provisioned according to the
+// StorageClass parameters.
+func newNFSVolume(name string, params map[string]string) (*nfsVolume, error) {
+	vol := &nfsVolume{
+		subDir:      name,
+		onDelete:    onDeleteDelete,
+		mountParams: map[string]string{},
+	}
+	for k, v := range params {
+		switch k {
+		case paramServer:
+			vol.server = v
+		case paramShare:
+			vol.baseShare = v
+		case paramOnDelete:
+			vol.onDelete = v
+		case paramNFSVers, paramProto, paramSec, paramHard, paramTimeo:
+			vol.mountParams[k] = v
+		default:
+			// Parameters reserved for the sidecars are not ours to check
+			if strings.HasPrefix(k, "csi.storage.k8s.io/") {
+				continue
+			}
+			return nil, status.Errorf(codes.InvalidArgument, "invalid parameter %s", k)
+		}
+	}
+
+	if vol.server == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s parameter missing", paramServer)
+	}
+	if strings.Contains(vol.server, volumeIDSeparator) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s parameter must not contain %q", paramServer, volumeIDSeparator)
+	}
+	if vol.baseShare == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s parameter missing", paramShare)
+	}
+	if strings.Contains(vol.baseShare, volumeIDSeparator) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s parameter must not contain %q", paramShare, volumeIDSeparator)
+	}
+	if vol.onDelete != onDeleteDelete && vol.onDelete != onDeleteArchive {
+		return nil, status.Errorf(codes.InvalidArgument, "%s parameter must be %q or %q, got %q", paramOnDelete, onDeleteDelete, onDeleteArchive, vol.onDelete)
+	}
+	return vol, nil
+}
+
+// id encodes vol as "<server>#<baseShare>#<subDir>#<onDelete>". If there
+// are mount parameters, their values follow as "#<nfsvers>,<proto>,..." in
+// the order of mountParameters, leaving unset ones empty. Only the values
+// are stored to keep the ID within maxVolumeIDLength.
+func (vol *nfsVolume) id() string {
+	fields := []string{vol.server, vol.baseShare, vol.subDir, vol.onDelete}
+	if len(vol.mountParams) > 0 {
+		values := make([]string, len(mountParameters))
+		for i, p := range mountParameters {
+			values[i] = vol.mountParams[p]
+		}
+		fields = append(fields, strings.Join(values, mountParamsSeparator))
+	}
+	return strings.Join(fields, volumeIDSeparator)
+}
+
+// share returns the export path of the volume directory.
+func (vol *nfsVolume) share() string {
+	return strings.TrimSuffix(vol.baseShare, "/") + "/" + vol.subDir
+}
+
+// parseVolumeID decodes a volume ID created by nfsVolume.id.
+func parseVolumeID(id string) (*nfsVolume, error) {
+	fields := strings.Split(id, volumeIDSeparator)
+	if len(fields) != 4 && len(fields) != 5 {
+		return nil, fmt.Errorf("volume id %s is not of the form server%sshare%sname%sonDelete[%smountParameters]", id, volumeIDSeparator, volumeIDSeparator, volumeIDSeparator, volumeIDSeparator)
+	}
+	vol := &nfsVolume{
+		server:      fields[0],
+		baseShare:   fields[1],
+		subDir:      fields[2],
+		onDelete:    fields[3],
+		mountParams: map[string]string{},
+	}
+	if vol.server == "" || vol.baseShare == "" || vol.subDir == "" {
+		return nil, fmt.Errorf("volume id %s has empty fields", id)
+	}
+	if err := validateVolumeName(vol.subDir); err != nil {
+		return nil, fmt.Errorf("volume id %s is invalid: %v", id, err)
+	}
+	if len(fields) == 5 {
+		values := strings.Split(fields[4], mountParamsSeparator)
+		if len(values) != len(mountParameters) {
+			return nil, fmt.Errorf("volume id %s has %d mount parameters, expected %d", id, len(values), len(mountParameters))
+		}
+		for i, v := range values {
+			if v == "" {
+				continue
+			}
+			if _, err := parameterMountOption(mountParameters[i], v); err != nil {
+				return nil, fmt.Errorf("volume id %s has invalid mount parameters: %s", id, status.Convert(err).Message())
+			}
+			vol.mountParams[mountParameters[i]] = v
+		}
+	}
+	return vol, nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+func newFakeControllerServer(t *testing.T) (*controllerServer, *mount.FakeMounter, func()) {
+	dir, err := ioutil.TempDir("", "nfs-controller")
+	assert.NoError(t, err)
+
+	d := NewDriver("fakeNodeID", "unix:///tmp/csi.sock", dir)
+	cs := NewControllerServer(d)
+	mounter := &mount.FakeMounter{}
+	cs.mounter = mounter
+	return cs, mounter, func() { os.RemoveAll(dir) }
+}
+
+func newCreateVolumeRequest(name string, params map[string]string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name: name,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{
+						MountFlags: []string{"nfsvers=4.1"},
+					},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+				},
+			},
+		},
+		Parameters: params,
+	}
+}
+
+func TestCreateVolumeInvalidArguments(t *testing.T) {
+	cs, _, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	tests := map[string]struct {
+		name   string
+		params map[string]string
+	}{
+		"missing name": {
+			params: map[string]string{paramServer: "server", paramShare: "/export"},
+		},
+		"name with separator": {
+			name:   "vol#1",
+			params: map[string]string{paramServer: "server", paramShare: "/export"},
+		},
+		"name with slash": {
+			name:   "vol/1",
+			params: map[string]string{paramServer: "server", paramShare: "/export"},
+		},
+		"dot name": {
+			name:   ".",
+			params: map[string]string{paramServer: "server", paramShare: "/export"},
+		},
+		"dot dot name": {
+			name:   "..",
+			params: map[string]string{paramServer: "server", paramShare: "/export"},
+		},
+		"missing server": {
+			name:   "vol",
+			params: map[string]string{paramShare: "/export"},
+		},
+		"missing share": {
+			name:   "vol",
+			params: map[string]string{paramServer: "server"},
+		},
+		"unknown parameter": {
+			name:   "vol",
+			params: map[string]string{paramServer: "server", paramShare: "/export", "foo": "bar"},
+		},
+		"invalid onDelete": {
+			name:   "vol",
+			params: map[string]string{paramServer: "server", paramShare: "/export", paramOnDelete: "retain"},
+		},
+		"volume id too long": {
+			name:   strings.Repeat("v", 100),
+			params: map[string]string{paramServer: "server", paramShare: "/export/" + strings.Repeat("s", 20)},
+		},
+	}
+	for name, test := range tests {
+		_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(test.name, test.params))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), name)
+	}
+}
+
+func TestCreateDeleteVolume(t *testing.T) {
+	for _, onDelete := range []string{onDeleteDelete, onDeleteArchive} {
+		cs, mounter, cleanup := newFakeControllerServer(t)
+		defer cleanup()
+
+		params := map[string]string{paramServer: "server", paramShare: "/export/", paramOnDelete: onDelete}
+		resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+		assert.NoError(t, err)
+		assert.Equal(t, "server#/export/#vol#"+onDelete, resp.GetVolume().GetVolumeId())
+		assert.Equal(t, map[string]string{paramServer: "server", paramShare: "/export/vol"}, resp.GetVolume().GetVolumeContext())
+
+		// The base export is mounted with the StorageClass mount options
+		// and unmounted again once the directory exists.
+		volPath := filepath.Join(cs.workingMountDir, "vol", "vol")
+		assert.DirExists(t, volPath)
+		assert.Empty(t, mounter.MountPoints)
+		assert.Equal(t, mount.FakeAction{Action: mount.FakeActionMount, Target: filepath.Join(cs.workingMountDir, "vol"), Source: "server:/export/", FSType: "nfs"}, mounter.Log[0])
+
+		// Creating the volume again is idempotent
+		_, err = cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+		assert.NoError(t, err)
+
+		_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+		assert.NoError(t, err)
+		_, err = os.Stat(volPath)
+		assert.True(t, os.IsNotExist(err))
+		if onDelete == onDeleteArchive {
+			archives, err := filepath.Glob(filepath.Join(cs.workingMountDir, "vol", archivePrefix+"vol-*"))
+			assert.NoError(t, err)
+			assert.Len(t, archives, 1)
+
+			// A new volume of the same name gets its own archive
+			_, err = cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+			assert.NoError(t, err)
+			_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+			assert.NoError(t, err)
+			archives, err = filepath.Glob(filepath.Join(cs.workingMountDir, "vol", archivePrefix+"vol-*"))
+			assert.NoError(t, err)
+			assert.Len(t, archives, 2)
+		}
+		assert.Empty(t, mounter.MountPoints)
+
+		// Deleting the volume again is idempotent
+		_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+		assert.NoError(t, err)
+	}
+}
+
+func TestCreateVolumeMountParameters(t *testing.T) {
+	cs, _, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	params := map[string]string{paramServer: "server", paramShare: "/export", paramNFSVers: "4.1", paramHard: "true"}
+	resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+	assert.NoError(t, err)
+	// Mount parameters are handed to the node and kept in the ID for
+	// DeleteVolume
+	assert.Equal(t, "server#/export#vol#delete#4.1,,,true,", resp.GetVolume().GetVolumeId())
+	assert.Equal(t, map[string]string{paramServer: "server", paramShare: "/export/vol", paramNFSVers: "4.1", paramHard: "true"}, resp.GetVolume().GetVolumeContext())
+
+	// The request mounts with nfsvers=4.1 as well
+	params[paramNFSVers] = "3"
+	_, err = cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestDeleteVolumeMountParameters(t *testing.T) {
+	cs, mounter, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	params := map[string]string{paramServer: "server", paramShare: "/export", paramNFSVers: "4.1", paramSec: "krb5"}
+	resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+	assert.NoError(t, err)
+
+	mounter.Log = nil
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+	assert.NoError(t, err)
+	// The base export is mounted with the parameters of the StorageClass
+	assert.Equal(t, mount.FakeAction{Action: mount.FakeActionMount, Target: filepath.Join(cs.workingMountDir, "vol"), Source: "server:/export", FSType: "nfs"}, mounter.Log[0])
+}
+
+func TestControllerMountErrors(t *testing.T) {
+	cs, _, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+	mounter := &fakeMounter{FakeMounter: &mount.FakeMounter{}, mountErr: errors.New("mount.nfs: access denied by server while mounting server:/export")}
+	cs.mounter = mounter
+
+	params := map[string]string{paramServer: "server", paramShare: "/export"}
+	_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("vol", params))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "server#/export#vol#delete"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestDeleteVolumeUnknownID(t *testing.T) {
+	cs, mounter, cleanup := newFakeControllerServer(t)
+	defer cleanup()
+
+	for _, id := range []string{
+		"data-id",
+		// Deleting these would remove the whole export or mount it above
+		// the working directory.
+		"server#/export#.#delete",
+		"server#/export#..#delete",
+		"server#/export#a/..#delete",
+	} {
+		_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: id})
+		assert.NoError(t, err, id)
+	}
+	assert.Empty(t, mounter.Log)
+}
+
+func TestParseVolumeID(t *testing.T) {
+	tests := map[string]struct {
+		id          string
+		expectedVol *nfsVolume
+	}{
+		"valid": {
+			id:          "server#/export#vol#delete",
+			expectedVol: &nfsVolume{server: "server", baseShare: "/export", subDir: "vol", onDelete: onDeleteDelete, mountParams: map[string]string{}},
+		},
+		"too few fields": {id: "server#/export#vol"},
+		"empty name":     {id: "server#/export##delete"},
+		"dot name":       {id: "server#/export#.#delete"},
+		"dot dot name":   {id: "server#/export#..#delete"},
+		"nested name":    {id: "server#/export#a/b#delete"},
+		"mount parameters": {
+			id:          "server#/export#vol#delete#4.1,,krb5,,",
+			expectedVol: &nfsVolume{server: "server", baseShare: "/export", subDir: "vol", onDelete: onDeleteDelete, mountParams: map[string]string{paramNFSVers: "4.1", paramSec: "krb5"}},
+		},
+		"too few mount parameters":      {id: "server#/export#vol#delete#4.1,,krb5"},
+		"invalid mount parameter":       {id: "server#/export#vol#delete#4.1,,kerberos,,"},
+		"query encoded mount parameter": {id: "server#/export#vol#delete#nfsvers=4.1"},
+	}
+	for name, test := range tests {
+		vol, err := parseVolumeID(test.id)
+		if test.expectedVol == nil {
+			assert.Error(t, err, name)
+			continue
+		}
+		assert.NoError(t, err, name)
+		assert.Equal(t, test.expectedVol, vol, name)
+	}
+}
@@ -19,6 +19,7 @@ package nfs
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
 
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
@@ -27,6 +28,9 @@ type driver struct {
 	csiDriver *csicommon.CSIDriver
 	endpoint  string
 
+	// workingMountDir is where the controller mounts base exports.
+	workingMountDir string
+
 	ids *csicommon.DefaultIdentityServer
 	ns  *nodeServer
 
@@ -42,19 +46,23 @@ var (
 	version = "1.0.0-rc2"
 )
 
-func NewDriver(nodeID, endpoint string) *driver {
+func NewDriver(nodeID, endpoint, workingMountDir string) *driver {
 	glog.Infof("Driver: %v version: %v", driverName, version)
 
 	d := &driver{}
 
 	d.endpoint = endpoint
+	d.workingMountDir = workingMountDir
 
 	csiDriver := csicommon.NewCSIDriver(driverName, version, nodeID)
 	csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
-	// NFS plugin does not support ControllerServiceCapability now.
-	// If support is added, it should set to appropriate
-	// ControllerServiceCapability RPC types.
-	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_UNKNOWN})
+	// Volumes are provisioned as subdirectories of a base export named by
+	// the StorageClass.
+	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	csiDriver.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	})
 
 	d.csiDriver = csiDriver
 
@@ -64,6 +72,9 @@ func NewDriver(nodeID, endpoint string) *driver {
 func NewNodeServer(d *driver) *nodeServer {
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		mounter:           mount.New(""),
+		forceUnmount:      forceUnmount,
+		refs:              newStagingRefs(),
 	}
 }
 
@@ -71,8 +82,7 @@ func (d *driver) Run() {
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(d.endpoint,
 		csicommon.NewDefaultIdentityServer(d.csiDriver),
-		// NFS plugin has not implemented ControllerServer.
-		nil,
+		NewControllerServer(d),
 		NewNodeServer(d))
 	s.Wait()
 }
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+// mountErrorMessages maps messages printed by mount.nfs to the gRPC code
+// reported for them. mount only returns a generic exit status, so its output
+// is all there is to tell the failures apart.
+var mountErrorMessages = []struct {
+	message string
+	code    codes.Code
+}{
+	// The server exists but does not export the requested path.
+	{"no such file or directory", codes.NotFound},
+	{"does not exist", codes.NotFound},
+	{"access denied by server", codes.PermissionDenied},
+	{"permission denied", codes.PermissionDenied},
+	{"timed out", codes.DeadlineExceeded},
+	// The server cannot be reached at all.
+	{"connection refused", codes.Unavailable},
+	{"no route to host", codes.Unavailable},
+	{"network is unreachable", codes.Unavailable},
+	{"host is down", codes.Unavailable},
+	{"failed to resolve server", codes.Unavailable},
+	{"name or service not known", codes.Unavailable},
+	{"invalid argument", codes.InvalidArgument},
+	{"bad option", codes.InvalidArgument},
+	{"incorrect mount option", codes.InvalidArgument},
+}
+
+// mountErrorCode classifies an error returned by mounting an NFS export.
+func mountErrorCode(err error) codes.Code {
+	if os.IsPermission(err) {
+		return codes.PermissionDenied
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range mountErrorMessages {
+		if strings.Contains(msg, m.message) {
+			return m.code
+		}
+	}
+	return codes.Internal
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Volume context parameters controlling how the export is mounted. They
+	// are set in the StorageClass for provisioned volumes or in the
+	// volumeAttributes of a pre-provisioned PersistentVolume.
+	paramNFSVers = "nfsvers"
+	paramProto   = "proto"
+	paramSec     = "sec"
+	// paramHard selects hard ("true") or soft ("false") mounts.
+	paramHard  = "hard"
+	paramTimeo = "timeo"
+)
+
+// mountParameters lists the volume context parameters translated into mount
+// options, in the order the options are emitted.
+var mountParameters = []string{paramNFSVers, paramProto, paramSec, paramHard, paramTimeo}
+
+// isMountParameter returns true if key is one of mountParameters.
+func isMountParameter(key string) bool {
+	for _, p := range mountParameters {
+		if p == key {
+			return true
+		}
+	}
+	return false
+}
+
+// mountOption is a parsed mount option. key is the canonical option name
+// used to detect conflicts, so that "vers" and "nfsvers" or "hard" and "soft"
+// are recognized as setting the same thing.
+type mountOption struct {
+	key   string
+	value string
+	// option is the option as passed to mount.
+	option string
+}
+
+// parseMountOption splits a mount flag into its canonical key and value.
+func parseMountOption(option string) mountOption {
+	key, value := option, ""
+	if i := strings.Index(option, "="); i >= 0 {
+		key, value = option[:i], option[i+1:]
+	}
+	switch key {
+	case "vers":
+		key = paramNFSVers
+	case "hard", "soft":
+		key, value = paramHard, strconv.FormatBool(key == "hard")
+	}
+	return mountOption{key: key, value: value, option: option}
+}
+
+// sameMountValue returns true if a and b set the option key to the same
+// value. NFS versions without a minor version are compared as minor version
+// 0, so that "vers=4" and "nfsvers=4.0" agree.
+func sameMountValue(key, a, b string) bool {
+	if key == paramNFSVers {
+		return normalizeNFSVers(a) == normalizeNFSVers(b)
+	}
+	return a == b
+}
+
+func normalizeNFSVers(vers string) string {
+	if !strings.Contains(vers, ".") {
+		return vers + ".0"
+	}
+	return vers
+}
+
+// parameterMountOption validates the volume context parameter key and returns
+// the mount option it stands for.
+func parameterMountOption(key, value string) (mountOption, error) {
+	switch key {
+	case paramNFSVers:
+		switch value {
+		case "3", "4", "4.0", "4.1", "4.2":
+		default:
+			return mountOption{}, status.Errorf(codes.InvalidArgument, "%s must be one of 3, 4, 4.0, 4.1 or 4.2, got %q", key, value)
+		}
+	case paramProto:
+		switch value {
+		case "tcp", "tcp6", "udp", "udp6", "rdma":
+		default:
+			return mountOption{}, status.Errorf(codes.InvalidArgument, "%s must be one of tcp, tcp6, udp, udp6 or rdma, got %q", key, value)
+		}
+	case paramSec:
+		switch value {
+		case "sys", "krb5", "krb5i", "krb5p":
+		default:
+			return mountOption{}, status.Errorf(codes.InvalidArgument, "%s must be one of sys, krb5, krb5i or krb5p, got %q", key, value)
+		}
+	case paramHard:
+		hard, err := strconv.ParseBool(value)
+		if err != nil {
+			return mountOption{}, status.Errorf(codes.InvalidArgument, "%s must be true or false, got %q", key, value)
+		}
+		if hard {
+			return mountOption{key: key, value: "true", option: "hard"}, nil
+		}
+		return mountOption{key: key, value: "false", option: "soft"}, nil
+	case paramTimeo:
+		if timeo, err := strconv.Atoi(value); err != nil || timeo <= 0 {
+			return mountOption{}, status.Errorf(codes.InvalidArgument, "%s must be a positive number of deciseconds, got %q", key, value)
+		}
+	}
+	return mountOption{key: key, value: value, option: key + "=" + value}, nil
+}
+
+// getMountOptions merges the mount parameters in volumeContext with the mount
+// flags of the volume capability. Parameters come first, followed by the
+// mount flags in their original order. A mount flag repeating a parameter
+// with the same value is dropped; setting the same option to two different
+// values, through parameters or flags, is rejected with InvalidArgument.
+func getMountOptions(volumeContext map[string]string, mountFlags []string) ([]string, error) {
+	var options []mountOption
+	for _, key := range mountParameters {
+		value, ok := volumeContext[key]
+		if !ok {
+			continue
+		}
+		o, err := parameterMountOption(key, value)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, o)
+	}
+
+	set := map[string]mountOption{}
+	for _, o := range options {
+		set[o.key] = o
+	}
+	for _, flag := range mountFlags {
+		o := parseMountOption(flag)
+		if isMountParameter(o.key) {
+			// Flags are subject to the same checks as parameters
+			if _, err := parameterMountOption(o.key, o.value); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid mount flag %s: %v", flag, status.Convert(err).Message())
+			}
+		}
+		if prev, ok := set[o.key]; ok {
+			if !sameMountValue(o.key, prev.value, o.value) {
+				return nil, status.Errorf(codes.InvalidArgument, "mount flag %s conflicts with %s", flag, prev.option)
+			}
+			continue
+		}
+		set[o.key] = o
+		options = append(options, o)
+	}
+
+	// NFSv4 requires a transport with congestion control
+	if vers, ok := set[paramNFSVers]; ok && strings.HasPrefix(vers.value, "4") {
+		if proto, ok := set[paramProto]; ok && strings.HasPrefix(proto.value, "udp") {
+			return nil, status.Errorf(codes.InvalidArgument, "%s conflicts with %s", proto.option, vers.option)
+		}
+	}
+
+	result := make([]string, 0, len(options))
+	for _, o := range options {
+		result = append(result, o.option)
+	}
+	return result, nil
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetMountOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		mountFlags    []string
+		options       []string
+		code          codes.Code
+	}{
+		{
+			name:       "mount flags only",
+			mountFlags: []string{"nfsvers=4.1", "noatime"},
+			options:    []string{"nfsvers=4.1", "noatime"},
+		},
+		{
+			name: "all parameters",
+			volumeContext: map[string]string{
+				paramServer:  "server",
+				paramShare:   "/export",
+				paramTimeo:   "600",
+				paramHard:    "false",
+				paramSec:     "krb5p",
+				paramProto:   "tcp",
+				paramNFSVers: "4.2",
+			},
+			options: []string{"nfsvers=4.2", "proto=tcp", "sec=krb5p", "soft", "timeo=600"},
+		},
+		{
+			name:          "parameters before mount flags",
+			volumeContext: map[string]string{paramHard: "true"},
+			mountFlags:    []string{"noatime", "nfsvers=3"},
+			options:       []string{"hard", "noatime", "nfsvers=3"},
+		},
+		{
+			name:          "mount flag repeating parameter",
+			volumeContext: map[string]string{paramNFSVers: "4.1", paramHard: "true"},
+			mountFlags:    []string{"vers=4.1", "hard"},
+			options:       []string{"nfsvers=4.1", "hard"},
+		},
+		{
+			name:          "mount flag repeating nfsvers without minor version",
+			volumeContext: map[string]string{paramNFSVers: "4.0"},
+			mountFlags:    []string{"vers=4"},
+			options:       []string{"nfsvers=4.0"},
+		},
+		{
+			name:          "mount flag conflicting with minor version",
+			volumeContext: map[string]string{paramNFSVers: "4"},
+			mountFlags:    []string{"vers=4.1"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:          "invalid nfsvers",
+			volumeContext: map[string]string{paramNFSVers: "5"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:          "invalid proto",
+			volumeContext: map[string]string{paramProto: "sctp"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:          "invalid sec",
+			volumeContext: map[string]string{paramSec: "none"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:          "invalid hard",
+			volumeContext: map[string]string{paramHard: "maybe"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:          "invalid timeo",
+			volumeContext: map[string]string{paramTimeo: "0"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:       "invalid mount flag",
+			mountFlags: []string{"sec=none"},
+			code:       codes.InvalidArgument,
+		},
+		{
+			name:          "mount flag conflicting with parameter",
+			volumeContext: map[string]string{paramNFSVers: "4.1"},
+			mountFlags:    []string{"vers=3"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:          "hard parameter conflicting with soft flag",
+			volumeContext: map[string]string{paramHard: "true"},
+			mountFlags:    []string{"soft"},
+			code:          codes.InvalidArgument,
+		},
+		{
+			name:       "conflicting mount flags",
+			mountFlags: []string{"hard", "soft"},
+			code:       codes.InvalidArgument,
+		},
+		{
+			name:          "nfsv4 over udp",
+			volumeContext: map[string]string{paramNFSVers: "4.0"},
+			mountFlags:    []string{"proto=udp"},
+			code:          codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := getMountOptions(test.volumeContext, test.mountFlags)
+		assert.Equal(t, test.code, status.Code(err), test.name)
+		assert.Equal(t, test.options, options, test.name)
+	}
+}
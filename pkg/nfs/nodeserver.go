@@ -19,10 +19,14 @@ package nfs
 import (
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
@@ -31,13 +35,81 @@ import (
 	"github.com/kubernetes-csi/drivers/pkg/csi-common"
 )
 
+const (
+	// paramSubPath names a directory within the export which is published
+	// instead of the whole export.
+	paramSubPath = "subPath"
+)
+
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
+	mounter mount.Interface
+	// forceUnmount unmounts a target without contacting the NFS server.
+	forceUnmount func(target string) error
+	refs         *stagingRefs
 }
 
+// NodePublishVolume bind-mounts the subPath directory of the export staged
+// at the staging path to the target path. Without a staging path, the export
+// is mounted to the target path directly.
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Block access type is not supported")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	subPath, err := getSubPath(req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		source  string
+		fsType  string
+		options []string
+	)
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) > 0 {
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err != nil || notMnt {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged at %s", req.GetVolumeId(), stagingPath)
+		}
+		fd, err := openSubPath(stagingPath, subPath)
+		if err != nil {
+			return nil, err
+		}
+		defer unix.Close(fd)
+		// Bind the opened directory rather than its path, which may have
+		// been replaced by a symlink since it was checked. mount runs in a
+		// child process, so /proc/self cannot be used.
+		source = fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd)
+		options = []string{"bind"}
+	} else {
+		if source, err = getSource(req.GetVolumeContext(), subPath); err != nil {
+			return nil, err
+		}
+		if options, err = getMountOptions(req.GetVolumeContext(), req.GetVolumeCapability().GetMount().GetMountFlags()); err != nil {
+			return nil, err
+		}
+		fsType = "nfs"
+	}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+
 	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
@@ -49,61 +121,277 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+	if notMnt {
+		glog.V(4).Infof("mounting %s at %s", source, targetPath)
+		if err := ns.mounter.Mount(source, targetPath, fsType, options); err != nil {
+			return nil, status.Error(mountErrorCode(err), err.Error())
+		}
 	}
-
-	mo := req.GetVolumeCapability().GetMount().GetMountFlags()
-	if req.GetReadonly() {
-		mo = append(mo, "ro")
+	if len(stagingPath) > 0 {
+		ns.refs.publish(stagingPath, targetPath)
 	}
 
-	s := req.GetVolumeContext()["server"]
-	ep := req.GetVolumeContext()["share"]
-	source := fmt.Sprintf("%s:%s", s, ep)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
 
-	mounter := mount.New("")
-	err = mounter.Mount(source, targetPath, "nfs", mo)
+// resolveSubPath resolves all symlinks in subPath within the export staged at
+// stagingPath and returns the resolved export root and the path relative to
+// it. Symlinks in the export are under the control of its users, so the
+// result is checked to still be within the export.
+func resolveSubPath(stagingPath, subPath string) (root, rel string, err error) {
+	root, err = filepath.EvalSymlinks(stagingPath)
+	if err != nil {
+		return "", "", status.Error(codes.Internal, err.Error())
+	}
+	source, err := filepath.EvalSymlinks(filepath.Join(root, subPath))
 	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
+		if os.IsNotExist(err) {
+			return "", "", status.Errorf(codes.NotFound, "%s %s does not exist in the export", paramSubPath, subPath)
 		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+		return "", "", status.Error(codes.Internal, err.Error())
+	}
+	rel, err = filepath.Rel(root, source)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", status.Errorf(codes.InvalidArgument, "%s %s resolves to %s outside of the export", paramSubPath, subPath, source)
+	}
+	return root, rel, nil
+}
+
+// openSubPath opens subPath within the export staged at stagingPath and
+// returns an O_PATH file descriptor for it, which the caller must close.
+// The resolved path is opened one component at a time without following
+// symlinks, so a component which was swapped for a symlink after
+// resolveSubPath checked it fails the open instead of leading out of the
+// export.
+func openSubPath(stagingPath, subPath string) (int, error) {
+	root, rel, err := resolveSubPath(stagingPath, subPath)
+	if err != nil {
+		return -1, err
+	}
+	return openBeneath(root, rel, subPath)
+}
+
+// openBeneath opens rel below root without following symlinks.
+func openBeneath(root, rel, subPath string) (int, error) {
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, status.Error(codes.Internal, err.Error())
+	}
+	if rel != "." {
+		for _, name := range strings.Split(rel, string(filepath.Separator)) {
+			child, err := unix.Openat(fd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			unix.Close(fd)
+			switch err {
+			case nil:
+				fd = child
+			case unix.ENOENT:
+				return -1, status.Errorf(codes.NotFound, "%s %s does not exist in the export", paramSubPath, subPath)
+			case unix.ENOTDIR, unix.ELOOP:
+				return -1, status.Errorf(codes.InvalidArgument, "%s %s changed while it was being published", paramSubPath, subPath)
+			default:
+				return -1, status.Error(codes.Internal, err.Error())
+			}
 		}
-		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+	// A symlink as the last component is opened as the link itself
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return -1, status.Error(codes.Internal, err.Error())
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		unix.Close(fd)
+		return -1, status.Errorf(codes.InvalidArgument, "%s %s changed while it was being published", paramSubPath, subPath)
+	}
+	return fd, nil
 }
 
+// NodeUnpublishVolume unmounts the target path and removes the target
+// directory. If this was the last target published from a staging path
+// whose unstage was deferred, the staging path is unmounted as well.
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	targetPath := req.GetTargetPath()
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	if err := ns.unmount(req.GetTargetPath()); err != nil {
+		return nil, err
+	}
+
+	if stagingPath, ok := ns.refs.unpublish(req.GetTargetPath()); ok {
+		glog.V(4).Infof("last target of %s unpublished, unstaging volume %s", stagingPath, req.GetVolumeId())
+		if err := ns.unmount(stagingPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
 
+// NodeStageVolume mounts the export to the staging path, so that all targets
+// of the volume on this node share a single NFS client mount.
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	// Check arguments
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Block access type is not supported")
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	source, err := getSource(req.GetVolumeContext(), "")
+	if err != nil {
+		return nil, err
+	}
+	options, err := getMountOptions(req.GetVolumeContext(), req.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, err
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "Targetpath not found")
+			if err := os.MkdirAll(stagingPath, 0750); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
 		} else {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
+
 	if notMnt {
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
+		glog.V(4).Infof("mounting %s at %s", source, stagingPath)
+		if err := ns.mounter.Mount(source, stagingPath, "nfs", options); err != nil {
+			return nil, status.Error(mountErrorCode(err), err.Error())
+		}
+	}
+	ns.refs.stage(stagingPath)
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the export from the staging path. While targets
+// are still published from it, the unmount is deferred until the last one
+// is unpublished.
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	// Check arguments
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetStagingTargetPath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if !ns.refs.unstage(stagingPath) {
+		glog.V(4).Infof("volume %s is still published from %s, deferring unstage", req.GetVolumeId(), stagingPath)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	if err := ns.unmount(stagingPath); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	return csicommon.GetVolumeStats(req.GetVolumePath())
+}
 
-	err = util.UnmountPath(req.GetTargetPath(), mount.New(""))
+// unmount unmounts target and removes the directory. Targets which are
+// missing or not mounted anymore are treated as unmounted, so that retries
+// succeed. Mounts whose server handle went stale are unmounted forcibly,
+// since a regular unmount needs to reach the server.
+func (ns *nodeServer) unmount(target string) error {
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(target)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		switch {
+		case os.IsNotExist(err):
+			glog.V(4).Infof("%s does not exist, already unmounted", target)
+			return nil
+		case util.IsCorruptedMnt(err):
+			glog.Warningf("%s is a stale mount, unmounting forcibly: %v", target, err)
+			if err := ns.forceUnmount(target); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		default:
+			return status.Error(codes.Internal, err.Error())
+		}
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	if !notMnt {
+		glog.V(4).Infof("unmounting %s", target)
+		if err := ns.mounter.Unmount(target); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "failed to remove %s: %v", target, err)
+	}
+	return nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return &csi.NodeUnstageVolumeResponse{}, nil
+// getSource returns the NFS source of subPath in the export named by the
+// volume context.
+func getSource(volumeContext map[string]string, subPath string) (string, error) {
+	s := volumeContext[paramServer]
+	if len(s) == 0 {
+		return "", status.Errorf(codes.InvalidArgument, "%s missing in volume context", paramServer)
+	}
+	ep := volumeContext[paramShare]
+	if len(ep) == 0 {
+		return "", status.Errorf(codes.InvalidArgument, "%s missing in volume context", paramShare)
+	}
+	if len(subPath) > 0 {
+		ep = path.Join(ep, subPath)
+	}
+	return fmt.Sprintf("%s:%s", s, ep), nil
 }
 
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
+// getSubPath returns the cleaned subPath of the volume context. It must stay
+// within the export.
+func getSubPath(volumeContext map[string]string) (string, error) {
+	subPath, ok := volumeContext[paramSubPath]
+	if !ok {
+		return "", nil
+	}
+	cleaned := path.Clean(subPath)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", status.Errorf(codes.InvalidArgument, "%s %s must be a relative path within the export", paramSubPath, subPath)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// forceUnmount unmounts target forcibly, falling back to detaching it lazily
+// if requests to the server are still outstanding.
+func forceUnmount(target string) error {
+	err := unix.Unmount(target, unix.MNT_FORCE)
+	if err == nil {
+		return nil
+	}
+	glog.Warningf("force unmount of %s failed, unmounting lazily: %v", target, err)
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v", target, err)
+	}
+	return nil
 }
@@ -0,0 +1,538 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// fakeMounter fails mounts with mountErr and mount point checks with
+// notMntErr if they are set.
+type fakeMounter struct {
+	*mount.FakeMounter
+	mountErr  error
+	notMntErr error
+}
+
+func (f *fakeMounter) Mount(source string, target string, fstype string, options []string) error {
+	if f.mountErr != nil {
+		return f.mountErr
+	}
+	// Bind mounts of an open file descriptor are recorded with the path it
+	// refers to
+	if strings.HasPrefix(source, fmt.Sprintf("/proc/%d/fd/", os.Getpid())) {
+		path, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		source = path
+	}
+	return f.FakeMounter.Mount(source, target, fstype, options)
+}
+
+func (f *fakeMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	if f.notMntErr != nil {
+		return false, f.notMntErr
+	}
+	return f.FakeMounter.IsLikelyNotMountPoint(file)
+}
+
+func newFakeNodeServer(t *testing.T) (*nodeServer, *fakeMounter, string, func()) {
+	dir, err := ioutil.TempDir("", "nfs-node")
+	assert.NoError(t, err)
+
+	d := NewDriver("fakeNodeID", "unix:///tmp/csi.sock", dir)
+	ns := NewNodeServer(d)
+	mounter := &fakeMounter{FakeMounter: &mount.FakeMounter{}}
+	ns.mounter = mounter
+	return ns, mounter, dir, func() { os.RemoveAll(dir) }
+}
+
+func newMountCapability(flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	volumeContext := map[string]string{paramServer: "server", paramShare: "/export"}
+
+	tests := []struct {
+		name     string
+		req      *csi.NodePublishVolumeRequest
+		mountErr error
+		code     codes.Code
+	}{
+		{
+			name: "missing capability",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol", VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "block capability",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:      "vol",
+				TargetPath:    "target",
+				VolumeContext: volumeContext,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				},
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing volume id",
+			req:  &csi.NodePublishVolumeRequest{VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing target path",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing server",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol", VolumeCapability: newMountCapability(), VolumeContext: map[string]string{paramShare: "/export"}},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing share",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol", VolumeCapability: newMountCapability(), VolumeContext: map[string]string{paramServer: "server"}},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "conflicting mount options",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability("soft"), VolumeContext: map[string]string{paramServer: "server", paramShare: "/export", paramHard: "true"}},
+			code: codes.InvalidArgument,
+		},
+		{
+			name:     "export missing",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			mountErr: errors.New("mount.nfs: mounting server:/export failed, reason given by server: No such file or directory"),
+			code:     codes.NotFound,
+		},
+		{
+			name:     "server unreachable",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			mountErr: errors.New("mount.nfs: No route to host"),
+			code:     codes.Unavailable,
+		},
+		{
+			name:     "server timed out",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			mountErr: errors.New("mount.nfs: Connection timed out"),
+			code:     codes.DeadlineExceeded,
+		},
+		{
+			name:     "invalid mount option",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability("foo"), VolumeContext: volumeContext},
+			mountErr: errors.New("mount.nfs: an incorrect mount option was specified"),
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "unknown failure",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			mountErr: errors.New("mount.nfs: something went wrong"),
+			code:     codes.Internal,
+		},
+		{
+			name: "success",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "vol", TargetPath: "target", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.OK,
+		},
+	}
+
+	for _, test := range tests {
+		ns, mounter, dir, cleanup := newFakeNodeServer(t)
+		mounter.mountErr = test.mountErr
+		if test.req.GetTargetPath() != "" {
+			test.req.TargetPath = filepath.Join(dir, test.req.GetTargetPath())
+		}
+
+		_, err := ns.NodePublishVolume(context.Background(), test.req)
+		assert.Equal(t, test.code, status.Code(err), test.name)
+		if test.code == codes.OK {
+			assert.Equal(t, []mount.MountPoint{{Device: "server:/export", Path: test.req.GetTargetPath(), Type: "nfs", Opts: []string{}}}, mounter.MountPoints, test.name)
+		}
+		cleanup()
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	staleErr := &os.PathError{Op: "lstat", Err: syscall.ESTALE}
+
+	tests := []struct {
+		name string
+		// createTarget creates the target directory, mounted makes it a
+		// mount point.
+		createTarget bool
+		mounted      bool
+		notMntErr    error
+		forceErr     error
+		forced       bool
+		code         codes.Code
+	}{
+		{
+			name: "missing target",
+			code: codes.OK,
+		},
+		{
+			name:         "target not mounted",
+			createTarget: true,
+			code:         codes.OK,
+		},
+		{
+			name:         "target mounted",
+			createTarget: true,
+			mounted:      true,
+			code:         codes.OK,
+		},
+		{
+			name:         "stale mount",
+			createTarget: true,
+			notMntErr:    staleErr,
+			forced:       true,
+			code:         codes.OK,
+		},
+		{
+			name:         "stale mount which cannot be unmounted",
+			createTarget: true,
+			notMntErr:    staleErr,
+			forceErr:     errors.New("device or resource busy"),
+			forced:       true,
+			code:         codes.Internal,
+		},
+		{
+			name:         "unexpected error",
+			createTarget: true,
+			notMntErr:    &os.PathError{Op: "lstat", Err: syscall.EACCES},
+			code:         codes.Internal,
+		},
+	}
+
+	for _, test := range tests {
+		ns, mounter, dir, cleanup := newFakeNodeServer(t)
+		target := filepath.Join(dir, "target")
+		if test.createTarget {
+			assert.NoError(t, os.Mkdir(target, 0750))
+		}
+		if test.mounted {
+			mounter.MountPoints = []mount.MountPoint{{Device: "server:/export", Path: target, Type: "nfs"}}
+		}
+		mounter.notMntErr = test.notMntErr
+		var forced bool
+		ns.forceUnmount = func(string) error {
+			forced = true
+			return test.forceErr
+		}
+
+		req := &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: target}
+		_, err := ns.NodeUnpublishVolume(context.Background(), req)
+		assert.Equal(t, test.code, status.Code(err), test.name)
+		assert.Equal(t, test.forced, forced, test.name)
+		if test.code == codes.OK {
+			assert.Empty(t, mounter.MountPoints, test.name)
+			_, err = os.Stat(target)
+			assert.True(t, os.IsNotExist(err), test.name)
+
+			// Unpublishing again succeeds as well
+			mounter.notMntErr = nil
+			_, err = ns.NodeUnpublishVolume(context.Background(), req)
+			assert.NoError(t, err, test.name)
+		}
+		cleanup()
+	}
+}
+
+func TestNodeUnpublishVolumeInvalidArguments(t *testing.T) {
+	ns, _, _, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{TargetPath: "/target"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	ns, mounter, dir, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	stagingPath := filepath.Join(dir, "staging")
+	volumeContext := map[string]string{paramServer: "server", paramShare: "/export", paramNFSVers: "4.1"}
+
+	tests := []struct {
+		name string
+		req  *csi.NodeStageVolumeRequest
+		code codes.Code
+	}{
+		{
+			name: "missing capability",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath, VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing volume id",
+			req:  &csi.NodeStageVolumeRequest{StagingTargetPath: stagingPath, VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing staging path",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol", VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing share",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath, VolumeCapability: newMountCapability(), VolumeContext: map[string]string{paramServer: "server"}},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "conflicting mount options",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath, VolumeCapability: newMountCapability("vers=3"), VolumeContext: volumeContext},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "success",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath, VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.OK,
+		},
+		{
+			name: "already staged",
+			req:  &csi.NodeStageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath, VolumeCapability: newMountCapability(), VolumeContext: volumeContext},
+			code: codes.OK,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := ns.NodeStageVolume(context.Background(), test.req)
+		assert.Equal(t, test.code, status.Code(err), test.name)
+	}
+	assert.Equal(t, []mount.MountPoint{{Device: "server:/export", Path: stagingPath, Type: "nfs", Opts: []string{}}}, mounter.MountPoints)
+}
+
+func TestNodePublishStagedVolume(t *testing.T) {
+	ns, mounter, dir, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	stagingPath := filepath.Join(dir, "staging")
+	volumeContext := map[string]string{paramServer: "server", paramShare: "/export", paramSubPath: "data"}
+	publishReq := func(target string, volumeContext map[string]string) *csi.NodePublishVolumeRequest {
+		return &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol",
+			StagingTargetPath: stagingPath,
+			TargetPath:        filepath.Join(dir, target),
+			VolumeCapability:  newMountCapability(),
+			VolumeContext:     volumeContext,
+		}
+	}
+
+	// Publishing requires the volume to be staged
+	_, err := ns.NodePublishVolume(context.Background(), publishReq("target1", volumeContext))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  newMountCapability(),
+		VolumeContext:     volumeContext,
+	})
+	assert.NoError(t, err)
+
+	// The sub path must exist in the export and stay within it
+	_, err = ns.NodePublishVolume(context.Background(), publishReq("target1", volumeContext))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = ns.NodePublishVolume(context.Background(), publishReq("target1", map[string]string{paramSubPath: "../data"}))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	assert.NoError(t, os.Mkdir(filepath.Join(stagingPath, "data"), 0750))
+	for _, target := range []string{"target1", "target2"} {
+		_, err = ns.NodePublishVolume(context.Background(), publishReq(target, volumeContext))
+		assert.NoError(t, err)
+	}
+	assert.Contains(t, mounter.MountPoints, mount.MountPoint{Device: filepath.Join(stagingPath, "data"), Path: filepath.Join(dir, "target1"), Opts: []string{}})
+	assert.Len(t, mounter.MountPoints, 3)
+
+	// Unstaging is deferred while targets are published
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: "vol", StagingTargetPath: stagingPath}
+	_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+	assert.NoError(t, err)
+	assert.Len(t, mounter.MountPoints, 3)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: filepath.Join(dir, "target1")})
+	assert.NoError(t, err)
+	assert.Len(t, mounter.MountPoints, 2)
+
+	// The last unpublish completes the unstage. The sub path is part of the
+	// export and disappears together with the staging mount.
+	assert.NoError(t, os.Remove(filepath.Join(stagingPath, "data")))
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: filepath.Join(dir, "target2")})
+	assert.NoError(t, err)
+	assert.Empty(t, mounter.MountPoints)
+	_, err = os.Stat(stagingPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Unstaging again succeeds as well
+	_, err = ns.NodeUnstageVolume(context.Background(), unstageReq)
+	assert.NoError(t, err)
+}
+
+func TestNodePublishStagedVolumeSymlinks(t *testing.T) {
+	ns, mounter, dir, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	stagingPath := filepath.Join(dir, "staging")
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  newMountCapability(),
+		VolumeContext:     map[string]string{paramServer: "server", paramShare: "/export"},
+	})
+	assert.NoError(t, err)
+
+	// Users of the export may create symlinks pointing anywhere
+	assert.NoError(t, os.Mkdir(filepath.Join(stagingPath, "data"), 0750))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "host"), 0750))
+	assert.NoError(t, os.Symlink("data", filepath.Join(stagingPath, "inside")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "host"), filepath.Join(stagingPath, "outside")))
+	assert.NoError(t, os.Mkdir(filepath.Join(stagingPath, "other"), 0750))
+	assert.NoError(t, os.Symlink("..", filepath.Join(stagingPath, "data", "parent")))
+
+	testCases := map[string]struct {
+		subPath      string
+		expectedCode codes.Code
+		// expectedSource is the bind-mounted directory on success.
+		expectedSource string
+	}{
+		"symlink within export":  {subPath: "inside", expectedCode: codes.OK, expectedSource: "data"},
+		"symlink out of export":  {subPath: "outside", expectedCode: codes.InvalidArgument},
+		"symlink through root":   {subPath: "data/parent/other", expectedCode: codes.OK, expectedSource: "other"},
+		"symlink through parent": {subPath: "data/parent/outside", expectedCode: codes.InvalidArgument},
+		"dangling symlink":       {subPath: "missing", expectedCode: codes.NotFound},
+	}
+	assert.NoError(t, os.Symlink("nowhere", filepath.Join(stagingPath, "missing")))
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			target := filepath.Join(dir, "target")
+			mounter.Log = nil
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol",
+				StagingTargetPath: stagingPath,
+				TargetPath:        target,
+				VolumeCapability:  newMountCapability(),
+				VolumeContext:     map[string]string{paramSubPath: tc.subPath},
+			})
+			assert.Equal(t, tc.expectedCode, status.Code(err))
+			if tc.expectedCode != codes.OK {
+				assert.Empty(t, mounter.Log)
+				return
+			}
+			root, err := filepath.EvalSymlinks(stagingPath)
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(root, tc.expectedSource), mounter.Log[0].Source)
+			assert.NoError(t, mounter.Unmount(target))
+		})
+	}
+}
+
+func TestOpenBeneath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfs-subpath")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "export")
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "data", "sub"), 0750))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "host", "sub"), 0750))
+
+	// Components swapped for a symlink after the sub path was resolved
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "parent"), 0750))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "host"), filepath.Join(root, "parent", "link")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "host"), filepath.Join(root, "link")))
+
+	testCases := map[string]struct {
+		rel          string
+		expectedCode codes.Code
+	}{
+		"export root":              {rel: ".", expectedCode: codes.OK},
+		"directory":                {rel: "data/sub", expectedCode: codes.OK},
+		"symlink as last element":  {rel: "parent/link", expectedCode: codes.InvalidArgument},
+		"symlink as inner element": {rel: "link/sub", expectedCode: codes.InvalidArgument},
+		"removed":                  {rel: "data/missing", expectedCode: codes.NotFound},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fd, err := openBeneath(root, tc.rel, tc.rel)
+			assert.Equal(t, tc.expectedCode, status.Code(err))
+			if tc.expectedCode != codes.OK {
+				return
+			}
+			defer unix.Close(fd)
+			path, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd))
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(root, tc.rel), path)
+		})
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, _, dir, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	// The volume was never published on this node
+	_, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "unknown", VolumePath: filepath.Join(dir, "missing")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The volume is not mounted at the path anymore
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol", VolumePath: dir})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumePath: dir})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	ns, _, _, cleanup := newFakeNodeServer(t)
+	defer cleanup()
+
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	var types []csi.NodeServiceCapability_RPC_Type
+	for _, cap := range resp.GetCapabilities() {
+		types = append(types, cap.GetRpc().GetType())
+	}
+	assert.Contains(t, types, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"sync"
+)
+
+// stagingRefs counts the target paths bind-mounted from every staging path,
+// so that a staged export is only unmounted once its last publisher is gone.
+// The counts are kept in memory: after a restart, targets published before
+// are not known, but unmounting the staging path does not affect existing
+// bind mounts of it.
+type stagingRefs struct {
+	sync.Mutex
+
+	// publishers maps a staging path to the target paths published from it.
+	publishers map[string]map[string]bool
+	// stagingPaths maps a target path to the staging path it was published
+	// from, since unpublish requests do not name the staging path.
+	stagingPaths map[string]string
+	// pendingUnstage holds staging paths whose unstage was requested while
+	// targets were still published from them.
+	pendingUnstage map[string]bool
+}
+
+func newStagingRefs() *stagingRefs {
+	return &stagingRefs{
+		publishers:     map[string]map[string]bool{},
+		stagingPaths:   map[string]string{},
+		pendingUnstage: map[string]bool{},
+	}
+}
+
+// stage records that stagingPath was (re)staged, canceling a pending unstage.
+func (r *stagingRefs) stage(stagingPath string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.pendingUnstage, stagingPath)
+}
+
+// publish records that targetPath is bind-mounted from stagingPath.
+func (r *stagingRefs) publish(stagingPath, targetPath string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.publishers[stagingPath] == nil {
+		r.publishers[stagingPath] = map[string]bool{}
+	}
+	r.publishers[stagingPath][targetPath] = true
+	r.stagingPaths[targetPath] = stagingPath
+}
+
+// unpublish forgets targetPath. It returns the staging path targetPath was
+// published from if that staging path is now due to be unstaged.
+func (r *stagingRefs) unpublish(targetPath string) (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+	stagingPath, ok := r.stagingPaths[targetPath]
+	if !ok {
+		return "", false
+	}
+	delete(r.stagingPaths, targetPath)
+	delete(r.publishers[stagingPath], targetPath)
+	if len(r.publishers[stagingPath]) > 0 {
+		return "", false
+	}
+	delete(r.publishers, stagingPath)
+	if !r.pendingUnstage[stagingPath] {
+		return "", false
+	}
+	delete(r.pendingUnstage, stagingPath)
+	return stagingPath, true
+}
+
+// unstage returns true if stagingPath can be unmounted right away. Otherwise
+// the unstage is deferred until the last target is unpublished.
+func (r *stagingRefs) unstage(stagingPath string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.publishers[stagingPath]) > 0 {
+		r.pendingUnstage[stagingPath] = true
+		return false
+	}
+	delete(r.pendingUnstage, stagingPath)
+	return true
+}